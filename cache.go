@@ -0,0 +1,83 @@
+package gziphandler
+
+import (
+	"container/list"
+	"sync"
+)
+
+// CompressedCache is an in-memory LRU cache of compressed
+// responses, keyed by their ETag, see
+// Options.CompressedCache. It is safe for concurrent use
+// and may be shared between handlers, though each only
+// reuses its own entries.
+type CompressedCache struct {
+	mu sync.Mutex
+
+	maxSize int64
+	size    int64
+
+	// The most recently used entries are at the front.
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key  string
+	body []byte
+}
+
+// NewCompressedCache returns a CompressedCache that holds
+// at most maxSize bytes of compressed responses. Responses
+// that compress to more than maxSize bytes are never
+// cached.
+func NewCompressedCache(maxSize int64) *CompressedCache {
+	return &CompressedCache{
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns the compressed response cached for key.
+func (c *CompressedCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	c.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry).body, true
+}
+
+// add caches body as the compressed response for key,
+// evicting the least recently used entries to make room.
+func (c *CompressedCache) add(key string, body []byte) {
+	size := int64(len(key) + len(body))
+	if size > c.maxSize {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+
+	for c.size+size > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key, body})
+	c.size += size
+}
+
+// remove removes e from the cache. c.mu must be held.
+func (c *CompressedCache) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.key) + len(entry.body))
+}
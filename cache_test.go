@@ -0,0 +1,37 @@
+package gziphandler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressedCache(t *testing.T) {
+	// Each entry takes 10 bytes, so three fit.
+	c := NewCompressedCache(30)
+	c.add("a", make([]byte, 9))
+	c.add("b", make([]byte, 9))
+	c.add("c", make([]byte, 9))
+
+	// Using a makes b the least recently used entry, so
+	// it is evicted to make room for d.
+	_, ok := c.get("a")
+	assert.True(t, ok)
+	c.add("d", make([]byte, 9))
+
+	for key, cached := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		_, ok := c.get(key)
+		assert.Equal(t, cached, ok, "for %s", key)
+	}
+
+	// Replacing an entry doesn't count it twice.
+	c.add("d", make([]byte, 9))
+	assert.Equal(t, int64(30), c.size)
+
+	// An entry larger than the cache is never cached, and
+	// doesn't evict anything.
+	c.add("e", make([]byte, 30))
+	_, ok = c.get("e")
+	assert.False(t, ok)
+	assert.Equal(t, 3, c.lru.Len())
+}
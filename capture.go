@@ -0,0 +1,70 @@
+//go:build !nogzip
+// +build !nogzip
+
+package gziphandler
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+)
+
+// ErrCaptureStatus is returned by CaptureVariants if the
+// handler responds with a status code outside of 2xx, as
+// such a response shouldn't be cached.
+var ErrCaptureStatus = errors.New("handler responded with a non-2xx status code")
+
+// CaptureVariants runs h once to generate the response to
+// r and returns both the identity and the gzip encoded
+// response bodies. It is intended for tools that warm
+// caches with both variants of deterministic responses,
+// not for serving requests.
+//
+// The Accept-Encoding header is removed from the request
+// passed to h, so that h may be wrapped with Gzip. The
+// response is compressed at the default compression
+// level. If h responds with a status code outside of
+// 2xx, CaptureVariants returns ErrCaptureStatus.
+func CaptureVariants(h http.Handler, r *http.Request) (identity, gz []byte, err error) {
+	r = r.Clone(r.Context())
+	r.Header.Del("Accept-Encoding")
+
+	cw := &captureResponseWriter{header: make(http.Header)}
+	h.ServeHTTP(cw, r)
+	if cw.code != 0 && (cw.code < 200 || cw.code > 299) {
+		return nil, nil, ErrCaptureStatus
+	}
+	identity = cw.body.Bytes()
+
+	var buf bytes.Buffer
+	if err := CompressTo(&buf, DefaultCompression, identity); err != nil {
+		return nil, nil, err
+	}
+
+	return identity, buf.Bytes(), nil
+}
+
+// captureResponseWriter is an http.ResponseWriter that
+// buffers the response body.
+type captureResponseWriter struct {
+	header http.Header
+	body   bytes.Buffer
+	code   int
+}
+
+func (w *captureResponseWriter) Header() http.Header { return w.header }
+
+func (w *captureResponseWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+
+	return w.body.Write(b)
+}
+
+func (w *captureResponseWriter) WriteHeader(code int) {
+	// Informational responses precede the final status.
+	if w.code == 0 && (code < 100 || code > 199) {
+		w.code = code
+	}
+}
@@ -0,0 +1,77 @@
+//go:build !nogzip
+// +build !nogzip
+
+package gziphandler
+
+import (
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCaptureVariants(t *testing.T) {
+	var calls int
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		io.WriteString(w, testBody)
+	})
+
+	for _, h := range []http.Handler{inner, Gzip(inner)} {
+		calls = 0
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+
+		identity, gz, err := CaptureVariants(h, req)
+		if !assert.NoError(t, err) {
+			continue
+		}
+
+		assert.Equal(t, 1, calls)
+		assert.Equal(t, testBody, string(identity))
+		assert.Equal(t, identity, MustGunzip(gz))
+		assert.Equal(t, "gzip", req.Header.Get("Accept-Encoding"), "request was modified")
+	}
+}
+
+func TestCaptureVariantsStatus(t *testing.T) {
+	for _, test := range []struct {
+		handler http.HandlerFunc
+		err     error
+	}{
+		{func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusCreated)
+			io.WriteString(w, testBody)
+		}, nil},
+		{func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusContinue)
+			io.WriteString(w, testBody)
+		}, nil},
+		{func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, testBody)
+			w.WriteHeader(http.StatusInternalServerError)
+		}, nil},
+		{func(w http.ResponseWriter, r *http.Request) {
+			http.NotFound(w, r)
+		}, ErrCaptureStatus},
+		{func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "failed", http.StatusInternalServerError)
+		}, ErrCaptureStatus},
+	} {
+		for _, h := range []http.Handler{test.handler, Gzip(test.handler)} {
+			req, _ := http.NewRequest("GET", "/whatever", nil)
+
+			identity, gz, err := CaptureVariants(h, req)
+			assert.Equal(t, test.err, err)
+			if err == nil {
+				assert.Equal(t, testBody, string(identity))
+				assert.Equal(t, identity, MustGunzip(gz))
+			} else {
+				assert.Nil(t, identity)
+				assert.Nil(t, gz)
+			}
+		}
+	}
+}
@@ -0,0 +1,57 @@
+//go:build !nogzip
+// +build !nogzip
+
+package gziphandler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sync"
+)
+
+// gzipWriterPools holds a pool of *gzip.Writers for each
+// compression level, indexed by level-DefaultCompression.
+var gzipWriterPools [BestCompression - DefaultCompression + 1]sync.Pool
+
+// Compress returns data compressed with gzip at the given
+// compression level. It is intended for compressing data
+// outside of an HTTP handler, such as cache entries. It
+// panics with ErrInvalidLevel if level is invalid.
+func Compress(level int, data []byte) []byte {
+	var buf bytes.Buffer
+	if err := CompressTo(&buf, level, data); err != nil {
+		panic(err)
+	}
+
+	return buf.Bytes()
+}
+
+// CompressTo writes data compressed with gzip at the given
+// compression level to w. It returns ErrInvalidLevel if
+// level is invalid.
+func CompressTo(w io.Writer, level int, data []byte) error {
+	if !validLevel(level) {
+		return ErrInvalidLevel
+	}
+
+	pool := &gzipWriterPools[level-DefaultCompression]
+
+	gw, ok := pool.Get().(*gzip.Writer)
+	if ok {
+		gw.Reset(w)
+	} else {
+		var err error
+		if gw, err = gzip.NewWriterLevel(w, level); err != nil {
+			return err
+		}
+	}
+
+	_, err := gw.Write(data)
+	if closeErr := gw.Close(); err == nil {
+		err = closeErr
+	}
+
+	pool.Put(gw)
+	return err
+}
@@ -0,0 +1,69 @@
+//go:build !nogzip
+// +build !nogzip
+
+package gziphandler
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompress(t *testing.T) {
+	for _, level := range []int{DefaultCompression, BestSpeed, 5, BestCompression} {
+		for i := 0; i < 2; i++ {
+			assert.Equal(t, gzipStrLevel(testBody, level), Compress(level, []byte(testBody)), "for level %d", level)
+
+			var buf bytes.Buffer
+			assert.NoError(t, CompressTo(&buf, level, []byte(testBody)), "for level %d", level)
+			assert.Equal(t, gzipStrLevel(testBody, level), buf.Bytes(), "for level %d", level)
+		}
+	}
+
+	assert.Equal(t, "", string(MustGunzip(Compress(DefaultCompression, nil))))
+}
+
+func TestCompressInvalidLevel(t *testing.T) {
+	for _, level := range []int{HuffmanOnly, NoCompression, 10, 42} {
+		assert.Equal(t, ErrInvalidLevel, CompressTo(ioutil.Discard, level, []byte(testBody)), "for level %d", level)
+		assertPanicsWith(t, ErrInvalidLevel, func() {
+			Compress(level, []byte(testBody))
+		})
+	}
+}
+
+func TestCompressToError(t *testing.T) {
+	errWrite := errors.New("write failed")
+	err := CompressTo(errorWriter{errWrite}, DefaultCompression, []byte(testBody))
+	assert.Equal(t, errWrite, err)
+}
+
+func TestCompressToReusesWriters(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool randomly drops items with the race detector enabled")
+	}
+
+	data := []byte(testBody)
+	CompressTo(ioutil.Discard, BestSpeed, data)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		CompressTo(ioutil.Discard, BestSpeed, data)
+	})
+	assert.Equal(t, 0.0, allocs, "CompressTo allocated")
+}
+
+// raceEnabled is set by race_test.go when the tests are
+// built with the race detector.
+var raceEnabled bool
+
+// errorWriter is an io.Writer whose writes always fail.
+type errorWriter struct {
+	err error
+}
+
+func (w errorWriter) Write(p []byte) (int, error) {
+	return 0, w.err
+}
@@ -0,0 +1,91 @@
+//go:build !nogzip
+// +build !nogzip
+
+package gziphandler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// ErrNegativeMaxDecompressed describes invalid
+// DecompressOptions. DecompressRequest panics with it if
+// MaxDecompressedSize is negative.
+var ErrNegativeMaxDecompressed = errors.New("maximum decompressed size must not be negative")
+
+// DecompressOptions is a struct that defines options to
+// customise the behaviour of DecompressRequest.
+type DecompressOptions struct {
+	// MaxDecompressedSize, if non-zero, is the maximum
+	// size of a decompressed request body. Requests with
+	// larger bodies are rejected with a 413 Request Entity
+	// Too Large response without calling the handler.
+	// This protects against zip-bomb style requests, where
+	// a small compressed body expands to a huge one.
+	//
+	// If MaxDecompressedSize is set, the request body is
+	// decompressed into memory before the handler is
+	// called. Otherwise, it is decompressed as it is read.
+	MaxDecompressedSize int64
+}
+
+// DecompressRequest wraps an HTTP handler, to transparently
+// decompress request bodies that were gzipped by the
+// client (via the Content-Encoding header). Requests with
+// invalid gzip bodies are rejected with a 400 Bad Request
+// response. If opts is nil, the default options are used.
+func DecompressRequest(h http.Handler, opts *DecompressOptions) http.Handler {
+	if opts == nil {
+		opts = new(DecompressOptions)
+	}
+
+	if opts.MaxDecompressedSize < 0 {
+		panic(ErrNegativeMaxDecompressed)
+	}
+
+	maxSize := opts.MaxDecompressedSize
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if canonicalEncoding(r.Header.Get("Content-Encoding")) != "gzip" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		gr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		var body io.ReadCloser = gr
+		contentLength := int64(-1)
+
+		if maxSize > 0 {
+			b, err := ioutil.ReadAll(io.LimitReader(gr, maxSize+1))
+			switch {
+			case err != nil:
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			case int64(len(b)) > maxSize:
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			body = ioutil.NopCloser(bytes.NewReader(b))
+			contentLength = int64(len(b))
+		}
+
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.Header = r.Header.Clone()
+		r2.Header.Del("Content-Encoding")
+		r2.Header.Del("Content-Length")
+		r2.Body = body
+		r2.ContentLength = contentLength
+
+		h.ServeHTTP(w, r2)
+	})
+}
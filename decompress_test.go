@@ -0,0 +1,77 @@
+//go:build !nogzip
+// +build !nogzip
+
+package gziphandler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecompressRequest(t *testing.T) {
+	for _, maxSize := range []int64{0, int64(len(testBody))} {
+		var body []byte
+		handler := DecompressRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "", r.Header.Get("Content-Encoding"))
+			body, _ = ioutil.ReadAll(r.Body)
+		}), &DecompressOptions{
+			MaxDecompressedSize: maxSize,
+		})
+
+		req, _ := http.NewRequest("POST", "/whatever", bytes.NewReader(gzipStrLevel(testBody, gzip.DefaultCompression)))
+		req.Header.Set("Content-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+
+		assert.Equal(t, http.StatusOK, resp.Code, "for maximum size %d", maxSize)
+		assert.Equal(t, testBody, string(body), "for maximum size %d", maxSize)
+	}
+}
+
+func TestDecompressRequestMaxSize(t *testing.T) {
+	// A small compressed body that expands beyond the
+	// maximum size.
+	bomb := gzipStrLevel(strings.Repeat("a", 1<<20), gzip.BestCompression)
+
+	handler := DecompressRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler called for request body larger than maximum size")
+	}), &DecompressOptions{
+		MaxDecompressedSize: 1 << 16,
+	})
+
+	req, _ := http.NewRequest("POST", "/whatever", bytes.NewReader(bomb))
+	req.Header.Set("Content-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	assert.True(t, len(bomb) < 1<<16, "compressed body is %d bytes", len(bomb))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.Code)
+}
+
+func TestDecompressRequestNegativeMaxSize(t *testing.T) {
+	assertPanicsWith(t, ErrNegativeMaxDecompressed, func() {
+		DecompressRequest(http.NotFoundHandler(), &DecompressOptions{
+			MaxDecompressedSize: -1,
+		})
+	})
+}
+
+func TestDecompressRequestInvalid(t *testing.T) {
+	handler := DecompressRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler called for invalid request body")
+	}), nil)
+
+	req, _ := http.NewRequest("POST", "/whatever", strings.NewReader(testBody))
+	req.Header.Set("Content-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
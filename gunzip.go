@@ -0,0 +1,58 @@
+//go:build !nogzip
+// +build !nogzip
+
+package gziphandler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"sync"
+)
+
+var gzipReaderPool sync.Pool
+
+// GunzipBytes decompresses the gzip data in b, such as the
+// body of a compressed response. The CRC-32 and length in
+// the gzip trailer are verified against the decompressed
+// data.
+func GunzipBytes(b []byte) ([]byte, error) {
+	br := bytes.NewReader(b)
+
+	gr, ok := gzipReaderPool.Get().(*gzip.Reader)
+	if ok {
+		if err := gr.Reset(br); err != nil {
+			gzipReaderPool.Put(gr)
+			return nil, err
+		}
+	} else {
+		var err error
+		if gr, err = gzip.NewReader(br); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := ioutil.ReadAll(gr)
+	if closeErr := gr.Close(); err == nil {
+		err = closeErr
+	}
+
+	gzipReaderPool.Put(gr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// MustGunzip is like GunzipBytes but panics if b cannot be
+// decompressed. It is intended for use in tests.
+func MustGunzip(b []byte) []byte {
+	data, err := GunzipBytes(b)
+	if err != nil {
+		panic("gziphandler: MustGunzip: " + err.Error())
+	}
+
+	return data
+}
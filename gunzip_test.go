@@ -0,0 +1,49 @@
+//go:build !nogzip
+// +build !nogzip
+
+package gziphandler
+
+import (
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGunzipBytes(t *testing.T) {
+	handler := newTestHandler(testBody)
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+
+		body, err := GunzipBytes(resp.Body.Bytes())
+		assert.NoError(t, err)
+		assert.Equal(t, testBody, string(body))
+	}
+}
+
+func TestGunzipBytesInvalid(t *testing.T) {
+	b := gzipStrLevel(testBody, gzip.DefaultCompression)
+
+	// Corrupt the CRC-32 in the trailer.
+	b[len(b)-8] ^= 0xff
+
+	_, err := GunzipBytes(b)
+	assert.Equal(t, gzip.ErrChecksum, err)
+
+	_, err = GunzipBytes([]byte(testBody))
+	assert.Equal(t, gzip.ErrHeader, err)
+
+	assert.Panics(t, func() {
+		MustGunzip([]byte(testBody))
+	}, "MustGunzip did not panic on invalid data")
+}
+
+func TestMustGunzip(t *testing.T) {
+	assert.Equal(t, testBody, string(MustGunzip(gzipStrLevel(testBody, gzip.BestSpeed))))
+}
@@ -1,22 +1,37 @@
+//go:build !nogzip
+// +build !nogzip
+
 package gziphandler
 
 import (
+	"bytes"
 	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"path"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/golang/gddo/httputil/header"
 )
 
 const defaultMinSize = 512
 
-var bufferPool = &sync.Pool{
-	New: func() interface{} {
-		buf := make([]byte, 0, defaultMinSize)
-		return &buf
-	},
-}
+// maxPooledBufferSize is the capacity above which buffers
+// are not returned to the pool, so that a large MinSize
+// doesn't keep large buffers alive between responses.
+const maxPooledBufferSize = 64 << 10
 
 // These constants are copied from the gzip package, so
 // that code that imports "github.com/tmthrgd/gziphandler"
@@ -47,47 +62,298 @@ type responseWriter struct {
 
 	h *handler
 
-	gw *gzip.Writer
+	// The request being responded to.
+	r *http.Request
+
+	// The content coding negotiated with the client,
+	// as it appeared in the Accept-Encoding header.
+	encoding string
+
+	gw GzipWriter
+
+	// The pool gw is taken from, which holds writers
+	// for the compression level of this response.
+	pool *writerPool
 
 	// Saves the WriteHeader value.
 	code int
 
+	// Whether the handler called WriteHeader with a
+	// final response code.
+	calledWriteHeader bool
+
+	// The minimum size of a response before it will be
+	// compressed.
+	minSize int
+
+	// Whether the response was checked against
+	// Options.AlwaysCompressTypes.
+	checkedType bool
+
 	// Holds the first part of the write before reaching
 	// the minSize or the end of the write.
 	buf *[]byte
 
 	state writerState
+
+	// Whether the header has been written to the
+	// underlying response.
+	wroteHeader bool
+
+	// Whether the response holds a slot of
+	// Options.MaxConcurrent.
+	acquired bool
+
+	// Whether Close has been called, after which writes
+	// fail with ErrWriteAfterClose.
+	closed bool
+
+	// The key of the response in Options.CompressedCache,
+	// if it may be cached.
+	cacheKey string
+
+	// Records the compressed response to be cached, if
+	// it wasn't already.
+	recording *recordingWriter
+
+	// Whether gw replays a compressed response from the
+	// cache rather than compressing.
+	cached bool
+
+	// Why the response was not compressed, see
+	// Stats.Reason.
+	reason Reason
+
+	// Whether the X-Uncompressed-Content-Length trailer
+	// was declared, see Options.UncompressedLengthTrailer.
+	lengthTrailer bool
+
+	// The destination of the compressed response, which
+	// gw writes to through sent.
+	dst io.Writer
+
+	// The buffer of Options.StreamBufferSize that dst
+	// writes through, if any.
+	streamBuf *streamBuffer
+
+	// Whether the headers of the compressed response have
+	// been committed, see commitGzip.
+	committed bool
+
+	// Whether gw has accepted writes other than the
+	// buffer, see abortGzip.
+	accepted bool
+
+	// Whether the request asked for a Content-Digest,
+	// see Options.EmitDigest.
+	wantDigest bool
+
+	// Whether each line is flushed, see
+	// Options.FlushOnNewline.
+	flushLines bool
+
+	// Holds the entire compressed response when it
+	// must be sent with a Content-Length, see
+	// HTTP10Buffer. If nil, the compressed response is
+	// streamed to the underlying response.
+	compressed *bytes.Buffer
+
+	// The number of bytes written by the handler.
+	written int64
+
+	// Counts the bytes written by gw.
+	sent countingWriter
+
+	// The time spent in calls to gw, if the handler
+	// collects stats.
+	compressDuration time.Duration
+
+	// Guards the methods above when the handler was
+	// created with Options.Synchronized.
+	mu sync.Mutex
 }
 
 // WriteHeader just saves the response code until close or
 // GZIP effective writes.
 func (w *responseWriter) WriteHeader(code int) {
+	if w.h.synchronized {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+	}
+
+	// Informational responses, such as 100 Continue,
+	// are not the final response code, so they are
+	// written immediately.
+	if code >= 100 && code <= 199 && code != http.StatusSwitchingProtocols {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+
 	w.code = code
+	w.calledWriteHeader = true
+
+	// If the response is passed through untouched from
+	// the start, the header is written immediately.
+	if w.state == writerStatePassThrough && !w.wroteHeader {
+		w.writeHeader()
+	}
 }
 
 // Write appends data to the gzip writer.
+//
+// Once the request's context is done, for instance because
+// the client went away, Write returns the context's error
+// so that the handler stops producing a response nobody
+// will receive.
 func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.h.synchronized {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+	}
+
+	if w.closed {
+		return 0, ErrWriteAfterClose
+	}
+
+	if err := w.r.Context().Err(); err != nil {
+		return 0, err
+	}
+
+	n, err := w.write(b)
+	w.written += int64(n)
+	if w.h.tap != nil {
+		w.writeTap(b[:n])
+	}
+	return n, err
+}
+
+// writeTap copies b, as written by the handler, to
+// Options.Tap.
+func (w *responseWriter) writeTap(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+
+	w.h.tapMu.Lock()
+	_, err := w.h.tap.Write(b)
+	w.h.tapMu.Unlock()
+
+	if err != nil && w.h.onError != nil {
+		w.h.onError(w.r, err)
+	}
+}
+
+func (w *responseWriter) write(b []byte) (int, error) {
 	if w.state == writerStatePassThrough {
+		if !w.wroteHeader {
+			w.writeHeader()
+		}
+
 		return w.ResponseWriter.Write(b)
 	}
 
 	// GZIP responseWriter is initialized. Use the GZIP
 	// responseWriter.
 	if w.gw != nil {
-		return w.gw.Write(b)
+		first := !w.committed
+		n, err := w.gzipWrite(b)
+		if err != nil && first {
+			// If nothing was sent, the response can still
+			// be passed through.
+			if err := w.abortGzip(err); err != nil {
+				return n, err
+			}
+
+			return w.write(b)
+		}
+
+		w.accepted = true
+		if err == nil && w.flushLines && len(b) != 0 && b[len(b)-1] == '\n' {
+			err = w.flushLine()
+		}
+
+		return n, err
+	}
+
+	// Multipart responses are live streams of parts, so
+	// they are passed through as soon as they are written
+	// rather than buffered.
+	if w.state == writerStateInitial && w.isMultipart() {
+		w.reason = ReasonDenied
+		if err := w.startPassThrough(); err != nil {
+			return 0, err
+		}
+		return w.ResponseWriter.Write(b)
+	}
+
+	// Types in Options.AlwaysCompressTypes are compressed
+	// whatever their size, so the decision needn't wait
+	// for minSize. The type is only checked on the first
+	// write, which holds the start of the body.
+	if w.minSize != 0 && !w.checkedType && len(b) != 0 {
+		w.checkedType = true
+		if w.alwaysCompressType(b) {
+			w.minSize = 0
+		}
 	}
 
-	// If the global writes are bigger than the minSize,
-	// compression is enable.
-	if buf := *w.buf; len(buf)+len(b) < w.h.minSize {
-		// Save the write into a buffer for later
-		// use in GZIP responseWriter (if content
-		// is long enough) or at close with regular
-		// responseWriter.
-		*w.buf = append(buf, b...)
-		return len(b), nil
+	// If the handler declared the length of the response,
+	// it is authoritative, so the response is not
+	// buffered. Otherwise, if the global writes are bigger
+	// than the minSize, compression is enable.
+	if cl := w.contentLength(); cl >= 0 {
+		if cl < int64(w.minSize) {
+			w.inferContentType(b)
+			w.reason = ReasonTooSmall
+			if err := w.startPassThrough(); err != nil {
+				return 0, err
+			}
+			return w.ResponseWriter.Write(b)
+		}
+	} else if !w.h.noBuffer && !w.estimatedLarge() && !w.streamsLines() {
+		var buf []byte
+		if w.buf != nil {
+			buf = *w.buf
+		}
+
+		if len(buf)+len(b) < w.threshold() {
+			// The buffer is only taken from the pool
+			// once it's needed.
+			if w.buf == nil {
+				w.buf = w.h.bufferPool.Get().(*[]byte)
+				buf = *w.buf
+
+				// Options.MinSizeFunc may return more than
+				// the buffer was allocated for, so grow it
+				// once rather than on each append. The
+				// larger buffer is returned to the pool
+				// unless it exceeds maxPooledBufferSize,
+				// beyond which it grows as needed.
+				size := w.threshold()
+				if size > maxPooledBufferSize {
+					size = maxPooledBufferSize
+				}
+				if cap(buf) < size {
+					buf = make([]byte, 0, size)
+				}
+			}
+
+			// Save the write into a buffer for later
+			// use in GZIP responseWriter (if content
+			// is long enough) or at close with regular
+			// responseWriter.
+			*w.buf = append(buf, b...)
+			return len(b), nil
+		}
 	}
 
+	return w.decide(b)
+}
+
+// decide determines whether the response, made up of the
+// buffered data followed by b, should be compressed and
+// writes b accordingly.
+func (w *responseWriter) decide(b []byte) (int, error) {
 	// If the writer is in the initial state,
 	// infer the content type and determine if the
 	// data should be compressed.
@@ -95,7 +361,8 @@ func (w *responseWriter) Write(b []byte) (int, error) {
 	// the 'pass-through' or 'compress' state.
 	if w.state == writerStateInitial {
 		w.inferContentType(b)
-		if w.h.canCompress != nil && !w.h.canCompress(w.Header()) {
+		if !w.shouldCompress(b) || !w.acquire() {
+			w.reason = ReasonDenied
 			if err := w.startPassThrough(); err != nil {
 				return 0, err
 			}
@@ -108,217 +375,1662 @@ func (w *responseWriter) Write(b []byte) (int, error) {
 		return 0, err
 	}
 
-	return w.gw.Write(b)
+	// The buffered data has been written, and there is
+	// nothing more to write when the decision is made on
+	// Close or Flush.
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	// startGzip falls back to passing the response
+	// through if it can't create a gzip writer.
+	return w.write(b)
 }
 
-// startPassThrough transition the writer to the 'pass-through' state.
-// This method is called when the data stream should not be compressed.
-func (w *responseWriter) startPassThrough() error {
-	// Write the header to regular response.
-	w.ResponseWriter.WriteHeader(w.code)
+// copyBufferPool holds the buffers ReadFrom reads into.
+var copyBufferPool = &sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 32*1024)
+		return &buf
+	},
+}
 
-	buf := *w.buf
+// ReadFrom reads from r until EOF or an error and writes
+// the data to the response. This makes responseWriter an
+// io.ReaderFrom.
+//
+// Once the response is passed through, ReadFrom is
+// delegated to the underlying http.ResponseWriter if it
+// is an io.ReaderFrom, so that io.Copy from an *os.File
+// may still use sendfile. Otherwise the data is read into
+// a reused buffer and written as with Write.
+func (w *responseWriter) ReadFrom(r io.Reader) (n int64, err error) {
+	if w.h.synchronized {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+	}
 
-	var err error
-	if len(buf) != 0 {
-		// Flush the buffer into the regular response.
-		_, err = w.ResponseWriter.Write(buf)
+	if w.closed {
+		return 0, ErrWriteAfterClose
 	}
 
-	// Empty the buffer.
-	*w.buf = buf[:0]
-	bufferPool.Put(w.buf)
-	w.buf = nil
+	defer func() { w.written += n }()
 
-	// Transition writer state to writerStatePassThrough
-	w.state = writerStatePassThrough
+	bufp := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(bufp)
+	buf := *bufp
 
-	return err
+	for {
+		// As with Write, stop copying once the request's
+		// context is done.
+		if err := w.r.Context().Err(); err != nil {
+			return n, err
+		}
+
+		// The underlying io.ReaderFrom would bypass
+		// Options.Tap.
+		if w.state == writerStatePassThrough && w.h.tap == nil {
+			if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+				if !w.wroteHeader {
+					w.writeHeader()
+				}
+
+				m, err := rf.ReadFrom(r)
+				return n + m, err
+			}
+		}
+
+		nr, er := r.Read(buf)
+		if nr > 0 {
+			nw, ew := w.write(buf[:nr])
+			n += int64(nw)
+			if w.h.tap != nil {
+				w.writeTap(buf[:nw])
+			}
+			if ew != nil {
+				return n, ew
+			}
+			if nw != nr {
+				return n, io.ErrShortWrite
+			}
+		}
+
+		switch er {
+		case nil:
+		case io.EOF:
+			return n, nil
+		default:
+			return n, er
+		}
+	}
 }
 
-// startGzip initialize any GZIP specific informations.
-func (w *responseWriter) startGzip() error {
-	h := w.Header()
+// alwaysCompressType reports whether the media type of
+// the response matches Options.AlwaysCompressTypes. If
+// the handler didn't set a Content-Type, it is sniffed
+// from the start of the body, as with inferContentType.
+func (w *responseWriter) alwaysCompressType(b []byte) bool {
+	if len(w.h.alwaysCompressTypes) == 0 {
+		return false
+	}
 
-	// Set the GZIP header.
-	h["Content-Encoding"] = []string{"gzip"}
+	mt := mediaType(w.Header())
+	if window := w.sniffWindow(b); mt == "" && len(window) != 0 {
+		mt = http.DetectContentType(window)
+		if idx := strings.IndexByte(mt, ';'); idx != -1 {
+			mt = mt[:idx]
+		}
+	}
 
-	// if the Content-Length is already set, then calls
-	// to Write on gzip will fail to set the
-	// Content-Length header since its already set
-	// See: https://github.com/golang/go/issues/14975.
-	delete(h, "Content-Length")
+	return matchMediaType(w.h.alwaysCompressTypes, mt)
+}
 
-	// Write the header to gzip response.
-	w.ResponseWriter.WriteHeader(w.code)
+// threshold returns the number of bytes buffered before
+// the decision to compress the response is made: minSize,
+// plus Options.DecisionWindow if the response is buffered
+// at all.
+func (w *responseWriter) threshold() int {
+	if w.minSize == 0 {
+		return 0
+	}
 
-	// Bytes written during ServeHTTP are redirected to
-	// this gzip writer before being written to the
-	// underlying response.
-	w.gw = w.h.pool.Get().(*gzip.Writer)
-	w.gw.Reset(w.ResponseWriter)
+	return w.minSize + w.h.decisionWindow
+}
 
-	buf := *w.buf
+// reachedMinSize reports whether the buffered start of the
+// response is long enough to be compressed, though the
+// decision was deferred by Options.DecisionWindow.
+func (w *responseWriter) reachedMinSize() bool {
+	return w.h.decisionWindow != 0 && w.minSize != 0 &&
+		w.buf != nil && len(*w.buf) >= w.minSize
+}
 
-	var err error
-	if len(buf) != 0 {
-		// Flush the buffer into the gzip response.
-		_, err = w.gw.Write(buf)
+// isMultipart reports whether the response is a multipart
+// stream, which is never buffered or compressed.
+func (w *responseWriter) isMultipart() bool {
+	return matchMediaType(multipartContentTypes, mediaType(w.Header()))
+}
+
+// streamsLines reports whether the response is a
+// newline-delimited stream whose lines are flushed, see
+// Options.FlushOnNewline.
+func (w *responseWriter) streamsLines() bool {
+	return w.h.flushOnNewline &&
+		matchMediaType(lineDelimitedContentTypes, mediaType(w.Header()))
+}
+
+// flushLine flushes the gzip writer and the underlying
+// response after a line of a newline-delimited stream.
+func (w *responseWriter) flushLine() error {
+	start := w.startTimer()
+	err := w.gw.Flush()
+	w.stopTimer(start)
+	if err == nil {
+		err = w.flushStreamBuffer()
+	}
+	if err != nil {
+		return err
 	}
 
-	// Empty the buffer.
-	*w.buf = buf[:0]
-	bufferPool.Put(w.buf)
-	w.buf = nil
+	if fw, ok := w.ResponseWriter.(http.Flusher); ok {
+		fw.Flush()
+	}
 
-	return err
+	return nil
 }
 
-func (w *responseWriter) inferContentType(b []byte) {
-	h := w.Header()
+// acquire reports whether the response may be compressed
+// without exceeding Options.MaxConcurrent. The slot it
+// takes is released in close.
+func (w *responseWriter) acquire() bool {
+	if w.h.sem == nil {
+		return true
+	}
 
-	// If content type is not set.
-	if _, ok := h["Content-Type"]; ok {
-		return
+	select {
+	case w.h.sem <- struct{}{}:
+		w.acquired = true
+		return true
+	default:
+		return false
 	}
+}
 
-	if buf := *w.buf; len(buf) != 0 {
-		const sniffLen = 512
-		if len(buf) >= sniffLen {
-			b = buf
-		} else if len(buf)+len(b) > sniffLen {
-			b = append(buf, b[:sniffLen-len(buf)]...)
-		} else {
-			b = append(buf, b...)
-		}
+// release releases the slot taken by acquire, if any.
+func (w *responseWriter) release() {
+	if w.acquired {
+		<-w.h.sem
+		w.acquired = false
 	}
+}
 
-	// It infer it from the uncompressed body.
-	h["Content-Type"] = []string{http.DetectContentType(b)}
+// flushStreamBuffer writes any compressed output held in
+// the buffer of Options.StreamBufferSize to the underlying
+// response.
+func (w *responseWriter) flushStreamBuffer() error {
+	if w.streamBuf == nil {
+		return nil
+	}
+
+	return w.streamBuf.Flush()
 }
 
-// Close will close the gzip.Writer and will put it back in
-// the gzipWriterPool.
-func (w *responseWriter) Close() error {
-	// Buffer not nil means the regular response must
-	// be returned.
-	if w.buf != nil {
-		w.inferContentType(nil)
+// releaseStreamBuffer flushes the buffer of
+// Options.StreamBufferSize and returns it to the pool.
+func (w *responseWriter) releaseStreamBuffer() error {
+	if w.streamBuf == nil {
+		return nil
+	}
 
-		w.ResponseWriter.WriteHeader(w.code)
+	err := w.streamBuf.Flush()
+	w.streamBuf.w, w.streamBuf.buf = nil, w.streamBuf.buf[:0]
+	w.h.streamBufferPool.Put(w.streamBuf)
+	w.streamBuf = nil
+	return err
+}
 
-		buf := *w.buf
+// gzipWrite writes b to the gzip writer.
+func (w *responseWriter) gzipWrite(b []byte) (int, error) {
+	start := w.startTimer()
+	n, err := w.gw.Write(b)
+	w.stopTimer(start)
+	return n, err
+}
 
-		// Make the write into the regular response.
-		_, err := w.ResponseWriter.Write(buf)
+// startTimer returns the current time if the handler
+// collects stats, or the zero time otherwise.
+func (w *responseWriter) startTimer() time.Time {
+	if w.h.stats == nil {
+		return time.Time{}
+	}
 
-		*w.buf = buf[:0]
-		bufferPool.Put(w.buf)
-		w.buf = nil
+	return time.Now()
+}
 
-		if err != nil {
-			return err
-		}
+// stopTimer adds the time elapsed since start, as returned
+// by startTimer, to the time spent compressing.
+func (w *responseWriter) stopTimer(start time.Time) {
+	if !start.IsZero() {
+		w.compressDuration += time.Since(start)
 	}
+}
 
-	// If the GZIP responseWriter is not set no needs
-	// to close it.
-	if w.gw == nil {
-		return nil
+// estimatedLarge reports whether the handler estimated,
+// with the Options.EstimateHeader header, that the
+// response is at least minSize.
+func (w *responseWriter) estimatedLarge() bool {
+	if w.h.estimateHeader == "" {
+		return false
 	}
 
-	err := w.gw.Close()
+	v, ok := w.Header()[w.h.estimateHeader]
+	if !ok || len(v) == 0 {
+		return false
+	}
 
-	w.h.pool.Put(w.gw)
-	w.gw = nil
+	n, err := strconv.ParseInt(v[0], 10, 64)
+	return err == nil && n >= int64(w.minSize)
+}
 
-	return err
+// compressedCacheKey returns the key of the response in
+// Options.CompressedCache, or an empty string if it may
+// not be cached. Only 200 OK responses with a strong
+// ETag are cached, as a weak ETag doesn't promise
+// identical bytes, and responses with Options.Padding
+// never are, as the padding is meant to differ between
+// responses. Responses that a shared cache may not store
+// bypass the cache entirely, though they are still
+// compressed.
+func (w *responseWriter) compressedCacheKey() string {
+	if w.h.cache == nil || w.h.padding != nil || w.code != http.StatusOK {
+		return ""
+	}
+
+	if !isShareable(w.Header()) {
+		return ""
+	}
+
+	etag := w.Header().Get("ETag")
+	if etag == "" || strings.HasPrefix(etag, "W/") {
+		return ""
+	}
+
+	// The same ETag may be used by different resources.
+	// Handlers sharing a cache may differ in the Level,
+	// GzipOS, GzipExtra or GzipWriter they compress with,
+	// so each handler's entries are kept apart, as are
+	// those for each level of LevelUnderPressure.
+	return etag + " " + w.r.Host + w.r.URL.RequestURI() +
+		" " + w.h.cacheID + "/" + strconv.Itoa(w.pool.level)
 }
 
-// Flush flushes the underlying *gzip.Writer and then the
-// underlying http.ResponseWriter if it is an http.Flusher.
-// This makes GzipResponseWriter an http.Flusher.
-func (w *responseWriter) Flush() {
-	if w.gw != nil {
-		w.gw.Flush()
+// contentLength returns the length of the response
+// declared by the Content-Length header, or -1 if the
+// header is absent or invalid.
+func (w *responseWriter) contentLength() int64 {
+	cl, ok := w.Header()["Content-Length"]
+	if !ok || len(cl) == 0 {
+		return -1
 	}
 
-	if fw, ok := w.ResponseWriter.(http.Flusher); ok {
-		fw.Flush()
+	n, err := strconv.ParseInt(cl[0], 10, 64)
+	if err != nil || n < 0 {
+		return -1
 	}
+
+	return n
 }
 
-type handler struct {
-	http.Handler
+// startPassThrough transition the writer to the 'pass-through' state.
+// This method is called when the data stream should not be compressed.
+func (w *responseWriter) startPassThrough() error {
+	// Write the header to regular response.
+	w.writeHeader()
 
-	pool *sync.Pool
+	// Flush the buffer into the regular response.
+	err := w.flushBuffer(w.ResponseWriter.Write)
 
-	minSize int
+	// Transition writer state to writerStatePassThrough
+	w.state = writerStatePassThrough
 
-	canCompress func(http.Header) bool
+	return err
 }
 
-func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	hdr := w.Header()
-	hdr["Vary"] = append(hdr["Vary"], "Accept-Encoding")
+// startGzip initialize any GZIP specific informations.
+func (w *responseWriter) startGzip() error {
+	// shouldCompress already refused encoded responses,
+	// but a response labelled gzip must never be
+	// compressed, and labelled, a second time.
+	if isEncoded(w.Header()) {
+		w.release()
+		w.reason = ReasonDenied
+		return w.startPassThrough()
+	}
 
-	var acceptsGzip bool
-	for _, spec := range header.ParseAccept(r.Header, "Accept-Encoding") {
-		if len(spec.Value) != len("gzip") {
-			continue
+	// A response whose declared length is within
+	// Options.BufferForContentLength is compressed in full,
+	// as with HTTP10Buffer, to be sent with its compressed
+	// length.
+	if w.compressed == nil && w.h.bufferForContentLength > 0 {
+		if cl := w.contentLength(); cl >= 0 && cl <= int64(w.h.bufferForContentLength) {
+			w.compressed = new(bytes.Buffer)
+			w.wantDigest = w.h.emitDigest && wantsContentDigest(w.r.Header)
 		}
+	}
 
-		if spec.Value == "gzip" || strings.ToLower(spec.Value) == "gzip" {
-			acceptsGzip = spec.Q > 0
-			break
-		}
+	// Bytes written during ServeHTTP are redirected to
+	// this gzip writer before being written to the
+	// underlying response.
+	var (
+		gw  GzipWriter
+		err error
+	)
+	if w.cacheKey = w.compressedCacheKey(); w.cacheKey == "" {
+		gw, err = w.pool.Get()
+	} else if body, ok := w.h.cache.get(w.cacheKey); ok {
+		// The handler's writes are discarded in favour of
+		// the response compressed for an earlier request.
+		// Nothing is compressed, so the slot of
+		// Options.MaxConcurrent is given up.
+		gw, w.cached = &replayWriter{body: body}, true
+		w.release()
+	} else {
+		gw, err = w.pool.Get()
+	}
+	if err != nil {
+		return w.abortGzip(err)
+	}
+	w.gw = gw
+
+	if w.compressed != nil {
+		// The header is written in Close once the
+		// Content-Length is known.
+		w.dst = w.compressed
+	} else if w.h.streamBufferPool != nil {
+		w.streamBuf = w.h.streamBufferPool.Get().(*streamBuffer)
+		w.streamBuf.w = w.ResponseWriter
+		w.dst = w.streamBuf
+	} else {
+		w.dst = w.ResponseWriter
 	}
 
-	if !acceptsGzip {
-		h.Handler.ServeHTTP(w, r)
-		return
+	if w.cacheKey != "" && !w.cached {
+		w.recording = &recordingWriter{Writer: w.dst, limit: w.h.cache.maxSize}
+		w.dst = w.recording
 	}
 
-	gw := &responseWriter{
-		ResponseWriter: w,
+	w.flushLines = w.compressed == nil && w.streamsLines()
 
-		h: h,
+	// The headers are only committed along with the first
+	// compressed bytes, see commitGzip.
+	w.sent.Writer = (*gzipCommitter)(w)
+	w.gw.Reset(&w.sent)
 
-		code: http.StatusOK,
+	if gw, ok := w.gw.(*gzip.Writer); ok {
+		if w.h.gzipOS != 0 {
+			gw.Header.OS = w.h.gzipOS
+		}
 
-		buf: bufferPool.Get().(*[]byte),
+		// Reset clears the header, so the extra field is
+		// set for each response.
+		gw.Header.Extra = w.h.gzipExtra
 
-		state: writerStateInitial,
+		if w.h.padding != nil {
+			if n := w.h.padding(); n > 0 {
+				gw.Header.Comment = strings.Repeat(" ", n)
+			}
+		}
 	}
-	defer gw.Close()
-
-	var rw http.ResponseWriter = gw
-
-	c, cok := w.(http.CloseNotifier)
-	hj, hok := w.(http.Hijacker)
-	p, pok := w.(http.Pusher)
 
-	switch {
-	case cok && hok:
-		rw = &closeNotifyHijackResponseWriter{gw, c, hj}
-	case cok && pok:
-		rw = &closeNotifyPusherResponseWriter{gw, c, p}
-	case cok:
-		rw = &closeNotifyResponseWriter{gw, c}
-	case hok:
-		rw = &hijackResponseWriter{gw, hj}
-	case pok:
-		rw = &pusherResponseWriter{gw, p}
+	// The buffer is kept until the headers are committed,
+	// so that it can still be passed through if the gzip
+	// writer fails before sending anything.
+	if w.buf != nil && len(*w.buf) != 0 {
+		if _, err := w.gzipWrite(*w.buf); err != nil {
+			return w.abortGzip(err)
+		}
 	}
 
-	h.Handler.ServeHTTP(rw, r)
+	return nil
 }
 
-// Gzip wraps an HTTP handler, to transparently gzip the
+// abortGzip passes err, from creating the gzip writer or
+// from the first write to it, to Options.OnError. If the
+// headers of the compressed response were not yet
+// committed, the response is passed through uncompressed
+// instead. Otherwise, it's too late and err is returned.
+func (w *responseWriter) abortGzip(err error) error {
+	if w.h.onError != nil {
+		w.h.onError(w.r, err)
+	}
+
+	// Once the writer has accepted writes that were not
+	// buffered, they can't be passed through instead.
+	if w.committed || w.accepted {
+		return err
+	}
+
+	// The writer may be broken, so it isn't returned to
+	// the pool.
+	w.gw = nil
+	w.release()
+	w.releaseStreamBuffer()
+	w.compressed = nil
+	w.cacheKey, w.recording, w.cached = "", nil, false
+	w.reason = ReasonError
+
+	// The state is changed before the header is written,
+	// so that Options.DebugHeader reports the response
+	// as passed through.
+	w.state = writerStatePassThrough
+	return w.startPassThrough()
+}
+
+// commitGzip sets the headers of the compressed response
+// and writes them, unless the response is buffered in full.
+// It is called before the first compressed bytes are
+// written, rather than when the gzip writer is created,
+// so that a writer that fails before writing anything
+// doesn't leave the headers of a compressed response
+// without a body.
+func (w *responseWriter) commitGzip() {
+	if w.committed {
+		return
+	}
+	w.committed = true
+
+	// The buffer was already compressed by startGzip.
+	w.releaseBuffer()
+
+	w.setGzipHeaders()
+
+	if w.cached {
+		// The length of the cached response is known
+		// up front.
+		w.Header()["Content-Length"] = []string{strconv.Itoa(len(w.gw.(*replayWriter).body))}
+	}
+
+	if w.compressed == nil {
+		w.writeHeader()
+	}
+}
+
+// gzipCommitter is the io.Writer the gzip writer writes
+// to. It commits the headers of the compressed response
+// before writing to the destination of the response.
+type gzipCommitter responseWriter
+
+func (c *gzipCommitter) Write(b []byte) (int, error) {
+	w := (*responseWriter)(c)
+	w.commitGzip()
+	return w.dst.Write(b)
+}
+
+// setGzipHeaders sets the headers of a compressed
+// response.
+func (w *responseWriter) setGzipHeaders() {
+	h := w.Header()
+
+	// Set the GZIP header.
+	addContentEncoding(h, canonicalEncoding(w.encoding))
+
+	// If the Content-Length is already set, it is the
+	// length of the uncompressed response, so preserve
+	// it for debugging and cache validation.
+	if cl, ok := h["Content-Length"]; ok && w.h.emitUncompressedLength {
+		h["X-Uncompressed-Content-Length"] = cl
+	}
+
+	// The length of a streamed response is only known once
+	// it ends, so it is sent in a trailer, which must be
+	// declared before the header is written.
+	if _, ok := h["X-Uncompressed-Content-Length"]; !ok &&
+		w.h.uncompressedLengthTrailer && w.compressed == nil {
+		h.Add("Trailer", "X-Uncompressed-Content-Length")
+		w.lengthTrailer = true
+	}
+
+	// if the Content-Length is already set, then calls
+	// to Write on gzip will fail to set the
+	// Content-Length header since its already set
+	// See: https://github.com/golang/go/issues/14975.
+	delete(h, "Content-Length")
+
+	// Byte ranges of the uncompressed response do not
+	// apply to the compressed response, so don't let
+	// clients or caches make range requests against it.
+	delete(h, "Accept-Ranges")
+
+	// The digests of a streamed response can't be known
+	// before it is sent. Those of a buffered response are
+	// recomputed by close.
+	if w.compressed == nil {
+		delete(h, "Content-Md5")
+		delete(h, "Digest")
+	}
+}
+
+// flushBuffer writes any buffered data with write and then
+// returns the buffer to the pool.
+func (w *responseWriter) flushBuffer(write func([]byte) (int, error)) error {
+	if w.buf == nil {
+		return nil
+	}
+
+	var err error
+	if len(*w.buf) != 0 {
+		_, err = write(*w.buf)
+	}
+
+	w.releaseBuffer()
+	return err
+}
+
+// releaseBuffer returns the buffer to the pool.
+func (w *responseWriter) releaseBuffer() {
+	if w.buf == nil {
+		return
+	}
+
+	buf := *w.buf
+
+	// Empty the buffer. Oversized buffers are left for
+	// the garbage collector rather than retained by the
+	// pool.
+	if cap(buf) <= maxPooledBufferSize {
+		*w.buf = buf[:0]
+		w.h.bufferPool.Put(w.buf)
+	}
+	w.buf = nil
+}
+
+// reportStats passes the Stats for the response to the
+// handler's Stats function. It is called once the
+// response has been closed.
+func (w *responseWriter) reportStats() {
+	compressed := w.state == writerStateCompress
+
+	encoding := "identity"
+	if compressed {
+		encoding = canonicalEncoding(w.encoding)
+	}
+
+	w.h.stats(w.r, Stats{
+		Compressed: compressed,
+
+		Encoding: encoding,
+		Reason:   w.reason,
+
+		Cached: w.cached,
+
+		CompressDuration: w.compressDuration,
+	})
+}
+
+// writeAuditLog writes a record describing the response to
+// the handler's audit log. It is called once the response
+// has been closed.
+func (w *responseWriter) writeAuditLog() {
+	rec := auditRecord{
+		Method:   w.r.Method,
+		Path:     w.r.URL.Path,
+		Encoding: "identity",
+		Size:     w.written,
+		SentSize: w.written,
+	}
+	if w.state == writerStateCompress {
+		rec.Encoding = canonicalEncoding(w.encoding)
+		rec.SentSize = w.sent.n
+	}
+
+	b, err := json.Marshal(&rec)
+	if err != nil {
+		return
+	}
+
+	w.h.auditMu.Lock()
+	w.h.auditLog.Write(append(b, '\n'))
+	w.h.auditMu.Unlock()
+}
+
+// auditRecord is a record written to Options.AuditLog.
+type auditRecord struct {
+	Method   string `json:"method"`
+	Path     string `json:"path"`
+	Encoding string `json:"encoding"`
+	Size     int64  `json:"size"`
+	SentSize int64  `json:"sent_size"`
+}
+
+// countingWriter is an io.Writer that counts the bytes
+// written to the underlying io.Writer.
+type countingWriter struct {
+	io.Writer
+
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.Writer.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// writeHeader writes the header with the saved response
+// code to the underlying response. It merges the Vary
+// header so that it includes Accept-Encoding exactly once,
+// however the handler set or added to it.
+func (w *responseWriter) writeHeader() {
+	mergeVary(w.Header())
+
+	if w.h.estimateHeader != "" {
+		delete(w.Header(), w.h.estimateHeader)
+	}
+
+	if w.h.optIn {
+		delete(w.Header(), OptInHeader)
+	}
+
+	if w.h.debugHeader {
+		w.Header()["X-Compression"] = []string{w.compression()}
+	}
+
+	if w.h.contentTypeRewrite != nil {
+		w.rewriteContentType()
+	}
+
+	w.ResponseWriter.WriteHeader(w.code)
+	w.wroteHeader = true
+}
+
+// compression describes how the response is sent for
+// Options.DebugHeader. It must be called before the
+// header is written, while a response that was buffered
+// and then passed through is still in the initial state.
+func (w *responseWriter) compression() string {
+	switch w.state {
+	case writerStateCompress:
+		return "gzip"
+	case writerStatePassThrough:
+		return "passthrough"
+	}
+
+	// A response to a HEAD request advertises the
+	// headers the response to a GET request would have.
+	if w.r.Method == http.MethodHead &&
+		w.Header().Get("Content-Encoding") == canonicalEncoding(w.encoding) {
+		return "gzip"
+	}
+
+	return "identity"
+}
+
+// rewriteContentType replaces the Content-Type header, if
+// it is set, with the result of Options.ContentTypeRewrite.
+func (w *responseWriter) rewriteContentType() {
+	h := w.Header()
+	if ct, ok := h["Content-Type"]; ok && len(ct) != 0 {
+		h["Content-Type"] = []string{w.h.contentTypeRewrite(ct[0])}
+	}
+}
+
+func (w *responseWriter) inferContentType(b []byte) {
+	if w.h.disableContentTypeSniff {
+		return
+	}
+
+	h := w.Header()
+
+	// If content type is not set.
+	if _, ok := h["Content-Type"]; ok {
+		return
+	}
+
+	// There's nothing to infer it from for a response
+	// without a body.
+	window := w.sniffWindow(b)
+	if len(window) == 0 {
+		return
+	}
+
+	// It infer it from the uncompressed body.
+	h["Content-Type"] = []string{http.DetectContentType(window)}
+}
+
+// sniffWindow returns up to the first 512 bytes of the
+// response, made up of the buffered data followed by b.
+func (w *responseWriter) sniffWindow(b []byte) []byte {
+	return w.window(b, 512)
+}
+
+// sampleWindow returns the start of the response that
+// Options.SniffText and Options.SampleRatio examine: up to
+// the first 512 bytes, or all of the response buffered
+// before the decision to compress it with
+// Options.DecisionWindow.
+func (w *responseWriter) sampleWindow(b []byte) []byte {
+	n := 512
+	if w.h.decisionWindow != 0 && w.threshold() > n {
+		n = w.threshold()
+	}
+
+	return w.window(b, n)
+}
+
+// window returns up to the first sniffLen bytes of the
+// response, made up of the buffered data followed by b.
+func (w *responseWriter) window(b []byte, sniffLen int) []byte {
+	if w.buf != nil && len(*w.buf) != 0 {
+		buf := *w.buf
+		if len(buf) >= sniffLen {
+			b = buf
+		} else if len(buf)+len(b) > sniffLen {
+			b = append(buf, b[:sniffLen-len(buf)]...)
+		} else {
+			b = append(buf, b...)
+		}
+	}
+
+	if len(b) > sniffLen {
+		b = b[:sniffLen]
+	}
+
+	return b
+}
+
+// Close will close the gzip.Writer and will put it back in
+// the gzipWriterPool.
+func (w *responseWriter) Close() error {
+	if w.h.synchronized {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+	}
+
+	// The response is closed once the handler returns,
+	// even if the handler already closed it.
+	if w.closed {
+		return nil
+	}
+
+	err := w.close()
+	w.closed = true
+
+	if w.h.flushOnClose && w.wroteHeader {
+		err = errors.Join(err, w.flushError())
+	}
+
+	return err
+}
+
+func (w *responseWriter) close() error {
+	// A response buffered within Options.DecisionWindow is
+	// long enough to compress, it just ended before the
+	// window was filled.
+	if w.state == writerStateInitial && w.reachedMinSize() {
+		if _, err := w.decide(nil); err != nil {
+			return err
+		}
+	}
+
+	// Writer still in the initial state means the
+	// regular response must be returned.
+	if w.state == writerStateInitial {
+		w.inferContentType(nil)
+		w.reason = ReasonTooSmall
+
+		// A response to a HEAD request has no body, but
+		// it should advertise the same headers as the
+		// response to a GET request would have. That is
+		// only known if the handler declared the length
+		// of the response.
+		if w.r.Method == http.MethodHead &&
+			w.contentLength() >= int64(w.minSize) &&
+			w.shouldCompress(nil) {
+			w.setGzipHeaders()
+		}
+
+		w.writeHeader()
+
+		// Make the write into the regular response.
+		err := w.flushBuffer(w.ResponseWriter.Write)
+
+		w.state = writerStatePassThrough
+
+		if err != nil {
+			return err
+		}
+	}
+
+	// A response passed through from the start, with no
+	// body and no call to WriteHeader, still needs its
+	// header fixed up before net/http sends it.
+	if w.state == writerStatePassThrough && !w.wroteHeader {
+		w.writeHeader()
+	}
+
+	// If the GZIP responseWriter is not set no needs
+	// to close it.
+	if w.gw == nil {
+		return nil
+	}
+
+	start := w.startTimer()
+	err := w.gw.Close()
+	w.stopTimer(start)
+
+	// A writer that wrote nothing, not even the gzip
+	// header, is broken. Nothing was sent, so rather
+	// than mislabel the response, it is passed through
+	// with what remains of the buffer, if the writer
+	// didn't accept anything else.
+	if !w.committed {
+		w.gw = nil
+		w.release()
+		w.releaseStreamBuffer()
+		w.compressed = nil
+		if w.accepted {
+			w.releaseBuffer()
+		}
+
+		w.reason = ReasonError
+		w.state = writerStatePassThrough
+		return errors.Join(err, w.startPassThrough())
+	}
+
+	err = errors.Join(err, w.releaseStreamBuffer())
+
+	if !w.cached {
+		w.pool.Put(w.gw)
+	}
+	w.gw = nil
+
+	if w.recording != nil && !w.recording.discarded && err == nil {
+		w.h.cache.add(w.cacheKey, w.recording.buf)
+	}
+	w.recording = nil
+
+	w.release()
+
+	if w.lengthTrailer {
+		w.Header()["X-Uncompressed-Content-Length"] = []string{strconv.FormatInt(w.written, 10)}
+	}
+
+	if w.compressed == nil || err != nil {
+		return err
+	}
+
+	// Write the fully compressed response along with
+	// its Content-Length. The handler may have modified
+	// the Content-Encoding header since the response was
+	// compressed, so it is set again.
+	h := w.Header()
+	h["Content-Encoding"] = []string{canonicalEncoding(w.encoding)}
+	h["Content-Length"] = []string{strconv.Itoa(w.compressed.Len())}
+	if _, ok := h["X-Uncompressed-Content-Length"]; !ok &&
+		(w.h.emitUncompressedLength || w.h.uncompressedLengthTrailer) {
+		h["X-Uncompressed-Content-Length"] = []string{strconv.FormatInt(w.written, 10)}
+	}
+	recomputeDigests(h, w.compressed.Bytes())
+	if w.wantDigest {
+		sum := sha256.Sum256(w.compressed.Bytes())
+		h["Content-Digest"] = []string{"sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"}
+	}
+	w.writeHeader()
+
+	_, err = w.compressed.WriteTo(w.ResponseWriter)
+	w.compressed = nil
+	return err
+}
+
+// isFlusher reports whether w can be flushed by
+// flushError.
+func isFlusher(w http.ResponseWriter) bool {
+	switch w.(type) {
+	case interface{ FlushError() error }, http.Flusher:
+		return true
+	default:
+		return false
+	}
+}
+
+// flushError flushes the underlying http.ResponseWriter
+// if it is an http.Flusher. It returns the error from
+// flushing if the underlying http.ResponseWriter has a
+// FlushError method.
+func (w *responseWriter) flushError() error {
+	switch fw := w.ResponseWriter.(type) {
+	case interface{ FlushError() error }:
+		return fw.FlushError()
+	case http.Flusher:
+		fw.Flush()
+	}
+
+	return nil
+}
+
+// Unwrap returns the underlying http.ResponseWriter. It
+// allows http.ResponseController to reach optional methods,
+// such as SetWriteDeadline, that ResponseWriter does
+// not implement itself, and lets HTTP/3 servers probe for
+// their own writer's interfaces.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Flush flushes the underlying *gzip.Writer and then the
+// underlying http.ResponseWriter if it is an http.Flusher.
+// This makes ResponseWriter an http.Flusher.
+//
+// It is always safe to call Flush. If the underlying
+// http.ResponseWriter is not an http.Flusher, only the
+// *gzip.Writer is flushed.
+func (w *responseWriter) Flush() {
+	if w.h.synchronized {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+	}
+
+	// As in close, a response buffered within
+	// Options.DecisionWindow is long enough to compress.
+	if w.state == writerStateInitial && w.reachedMinSize() {
+		w.decide(nil)
+	}
+
+	if w.gw != nil {
+		start := w.startTimer()
+		w.gw.Flush()
+		w.stopTimer(start)
+
+		// A writer may not have written anything yet,
+		// but flushing the underlying response sends
+		// the headers, so they must be committed first.
+		if w.compressed == nil {
+			w.commitGzip()
+			w.flushStreamBuffer()
+		}
+	}
+
+	// Flushing the underlying response would send the
+	// header before the Content-Length is known.
+	if w.compressed != nil {
+		return
+	}
+
+	// A flush before the compression decision was made
+	// means the handler intends to stream, so the
+	// response is passed through rather than held back
+	// until minSize is reached. If the handler has
+	// neither written nor set a response code, there is
+	// nothing to send yet.
+	if w.state == writerStateInitial {
+		// If the underlying response can't be flushed, as
+		// with http.TimeoutHandler which buffers the
+		// response itself, nothing would be streamed by
+		// giving up on compression.
+		if !isFlusher(w.ResponseWriter) {
+			return
+		}
+
+		buffered := w.buf != nil && len(*w.buf) != 0
+		if !buffered && !w.calledWriteHeader {
+			return
+		}
+
+		if buffered {
+			w.inferContentType(nil)
+		}
+
+		w.reason = ReasonTooSmall
+		w.startPassThrough()
+	}
+
+	if fw, ok := w.ResponseWriter.(http.Flusher); ok {
+		fw.Flush()
+	}
+}
+
+type handler struct {
+	http.Handler
+
+	pool *writerPool
+
+	// levelPools holds a pool for each compression
+	// level, indexed by level-DefaultCompression, if
+	// the handler was created with
+	// Options.LevelUnderPressure.
+	levelPools []*writerPool
+
+	levelUnderPressure func() int
+
+	// bufferPool holds the buffers used to hold the
+	// start of a response until minSize is reached.
+	// It is per-handler so that buffers are not
+	// shared between handlers and are released
+	// along with the handler.
+	bufferPool *sync.Pool
+
+	// streamBufferPool holds the buffers of
+	// Options.StreamBufferSize, or is nil.
+	streamBufferPool *sync.Pool
+
+	minSize int
+
+	minSizeFunc func(*http.Request) int
+
+	canCompress func(http.Header) bool
+
+	canCompressFull func(*http.Request, http.Header) bool
+
+	onlyCacheable bool
+
+	emitUncompressedLength bool
+
+	uncompressedLengthTrailer bool
+
+	decisionWindow int
+
+	bufferForContentLength int
+
+	synchronized bool
+
+	disableContentTypeSniff bool
+
+	http10Mode HTTP10Mode
+
+	gzipOS byte
+
+	gzipExtra []byte
+
+	sniffText bool
+
+	flushOnClose bool
+
+	stats func(*http.Request, Stats)
+
+	noBuffer bool
+
+	skipLocalhost bool
+
+	auditLog io.Writer
+	auditMu  sync.Mutex
+
+	tap   io.Writer
+	tapMu sync.Mutex
+
+	sampleRatio float64
+
+	onPush func(target string, opts *http.PushOptions)
+
+	assumeGzip bool
+
+	skipAttachments bool
+
+	skipScriptTypes bool
+
+	skipOnSetCookie bool
+
+	alwaysCompressRoutes []string
+
+	alwaysCompressTypes []string
+
+	cache *CompressedCache
+
+	// Distinguishes the handler's entries in cache from
+	// those of other handlers sharing it.
+	cacheID string
+
+	flushOnNewline bool
+
+	padding func() int
+
+	debugDisableParam  string
+	debugDisableCookie string
+
+	contentTypeRewrite func(string) string
+
+	maxCompressInput int64
+
+	onError func(*http.Request, error)
+
+	debugHeader bool
+
+	emitDigest bool
+
+	recomputeDigest bool
+
+	// estimateHeader is the canonical form of
+	// Options.EstimateHeader.
+	estimateHeader string
+
+	optIn bool
+
+	// sem limits the number of responses compressed at
+	// once to Options.MaxConcurrent, if it is non-zero.
+	sem chan struct{}
+}
+
+// shouldCompress reports whether the response should be
+// compressed. b is the data being written that has not
+// been buffered.
+func (w *responseWriter) shouldCompress(b []byte) bool {
+	h, hdr := w.h, w.Header()
+
+	// If the response is already encoded, for instance
+	// by an upstream server behind a reverse proxy, it
+	// must not be compressed again.
+	if isEncoded(hdr) {
+		return false
+	}
+
+	// The Content-Range of a partial response refers to
+	// the uncompressed representation, so the range must
+	// not be compressed.
+	if _, ok := hdr["Content-Range"]; ok {
+		return false
+	}
+
+	if h.optIn && hdr.Get(OptInHeader) != "1" {
+		return false
+	}
+
+	if w.isMultipart() {
+		return false
+	}
+
+	// A digest the handler computed over the uncompressed
+	// response would not match the compressed response.
+	if !h.recomputeDigest && hasDigest(hdr) {
+		return false
+	}
+
+	if h.maxCompressInput > 0 && w.contentLength() > h.maxCompressInput {
+		return false
+	}
+
+	if h.onlyCacheable && !isCacheable(hdr) {
+		return false
+	}
+
+	if h.skipAttachments && isAttachment(hdr) {
+		return false
+	}
+
+	if h.skipOnSetCookie {
+		if _, ok := hdr["Set-Cookie"]; ok {
+			return false
+		}
+	}
+
+	if h.skipScriptTypes && matchMediaType(scriptContentTypes, mediaType(hdr)) {
+		return false
+	}
+
+	// If the Content-Type doesn't say what the response
+	// is, look at the response itself.
+	switch mt := mediaType(hdr); {
+	case h.sniffText && (mt == "" || mt == "application/octet-stream"):
+		if !isText(w.sampleWindow(b)) {
+			return false
+		}
+	case h.canCompressFull != nil:
+		if !h.canCompressFull(w.r, hdr) {
+			return false
+		}
+	case h.canCompress != nil:
+		if !h.canCompress(hdr) {
+			return false
+		}
+	}
+
+	return h.sampleRatio == 0 || w.sampleRatio(b) <= h.sampleRatio
+}
+
+// sampleRatio compresses the start of the response and
+// returns the ratio of the compressed size to the
+// uncompressed size.
+//
+// When the response isn't buffered, for instance because
+// it declared its length or with NoBuffer, the sample may
+// be just the first write. A sample smaller than
+// MinRecommendedSize says little about the rest of the
+// response, so it is trusted to compress.
+func (w *responseWriter) sampleRatio(b []byte) float64 {
+	sample := w.sampleWindow(b)
+	if len(sample) < MinRecommendedSize {
+		return 0
+	}
+
+	cw := &countingWriter{Writer: ioutil.Discard}
+
+	gw, err := w.pool.Get()
+	if err != nil {
+		// The error is reported once the response
+		// fails to start compressing.
+		return 0
+	}
+
+	gw.Reset(cw)
+	gw.Write(sample)
+	gw.Close()
+	w.pool.Put(gw)
+
+	// Don't count the gzip header and trailer.
+	const gzipOverhead = 18
+	return float64(cw.n-gzipOverhead) / float64(len(sample))
+}
+
+// isText reports whether b looks like text. That is,
+// whether more than 90% of b is printable ASCII or
+// whitespace.
+func isText(b []byte) bool {
+	var binary int
+	for _, c := range b {
+		switch {
+		case c >= 0x20 && c < 0x7f:
+		case c == '\t', c == '\n', c == '\r':
+		default:
+			binary++
+		}
+	}
+
+	return binary*10 < len(b)
+}
+
+// isCacheable reports whether the response headers mark
+// the response as cacheable. A response is cacheable if
+// it has a Cache-Control header with the public directive
+// or if it has an ETag header, unless the Cache-Control
+// header also contains the no-store directive.
+func isCacheable(hdr http.Header) bool {
+	var public bool
+	for _, directive := range header.ParseList(hdr, "Cache-Control") {
+		switch strings.ToLower(directive) {
+		case "no-store":
+			return false
+		case "public":
+			public = true
+		}
+	}
+
+	_, hasETag := hdr["Etag"]
+	return public || hasETag
+}
+
+// isShareable reports whether the Cache-Control header
+// allows a shared cache to store the response, that is
+// whether it has neither the no-store nor the private
+// directive. The cache is shared between clients, so a
+// private response could otherwise be served to another.
+func isShareable(hdr http.Header) bool {
+	for _, directive := range header.ParseList(hdr, "Cache-Control") {
+		name, _, _ := strings.Cut(directive, "=")
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "no-store", "private":
+			return false
+		}
+	}
+
+	return true
+}
+
+// wantsContentDigest reports whether the request's
+// Want-Content-Digest header, as defined in RFC 9530,
+// gives sha-256 a non-zero preference. The header is a
+// dictionary of algorithms and their preferences, from 1
+// to 10, where 0 means the algorithm isn't acceptable.
+func wantsContentDigest(hdr http.Header) bool {
+	for _, v := range hdr["Want-Content-Digest"] {
+		for _, member := range strings.Split(v, ",") {
+			alg, pref, _ := strings.Cut(member, "=")
+			if strings.TrimSpace(alg) != "sha-256" {
+				continue
+			}
+
+			// Ignore any parameters.
+			pref, _, _ = strings.Cut(pref, ";")
+			n, err := strconv.Atoi(strings.TrimSpace(pref))
+			return err == nil && n > 0
+		}
+	}
+
+	return false
+}
+
+// isAttachment reports whether the Content-Disposition
+// of the response is attachment.
+func isAttachment(hdr http.Header) bool {
+	disposition, _, _ := strings.Cut(hdr.Get("Content-Disposition"), ";")
+	return strings.EqualFold(strings.TrimSpace(disposition), "attachment")
+}
+
+// isEncoded reports whether the Content-Encoding header
+// lists any content coding other than identity, on any of
+// its lines.
+func isEncoded(hdr http.Header) bool {
+	if _, ok := hdr["Content-Encoding"]; !ok {
+		return false
+	}
+
+	for _, v := range header.ParseList(hdr, "Content-Encoding") {
+		if !strings.EqualFold(v, "identity") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// addContentEncoding appends enc to the Content-Encoding
+// header, which lists the content codings in the order
+// they were applied. identity is dropped from the list, as
+// is any earlier occurrence of enc.
+func addContentEncoding(hdr http.Header, enc string) {
+	if _, ok := hdr["Content-Encoding"]; !ok {
+		hdr["Content-Encoding"] = []string{enc}
+		return
+	}
+
+	var codings []string
+	for _, v := range header.ParseList(hdr, "Content-Encoding") {
+		if !strings.EqualFold(v, "identity") && !strings.EqualFold(v, enc) {
+			codings = append(codings, v)
+		}
+	}
+
+	hdr["Content-Encoding"] = append(codings, enc)
+}
+
+// isUpgrade reports whether the request asks to switch
+// protocols, such as for a WebSocket handshake, or is a
+// CONNECT request.
+func isUpgrade(r *http.Request) bool {
+	if r.Method == http.MethodConnect {
+		return true
+	}
+
+	if _, ok := r.Header["Upgrade"]; ok {
+		return true
+	}
+
+	for _, v := range r.Header["Connection"] {
+		for v != "" {
+			var token string
+			token, v, _ = strings.Cut(v, ",")
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// isLoopback reports whether the request was made from a
+// loopback address.
+func isLoopback(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// hasDigest reports whether hdr has a Content-MD5 or
+// Digest header.
+func hasDigest(hdr http.Header) bool {
+	_, md5ok := hdr["Content-Md5"]
+	_, digestok := hdr["Digest"]
+	return md5ok || digestok
+}
+
+// recomputeDigests replaces the Content-MD5 and Digest
+// headers, if present, with the digests of body. Digest
+// algorithms that aren't supported are dropped.
+func recomputeDigests(hdr http.Header, body []byte) {
+	if _, ok := hdr["Content-Md5"]; ok {
+		sum := md5.Sum(body)
+		hdr["Content-Md5"] = []string{base64.StdEncoding.EncodeToString(sum[:])}
+	}
+
+	if _, ok := hdr["Digest"]; !ok {
+		return
+	}
+
+	var digests []string
+	for _, line := range hdr["Digest"] {
+		for _, v := range strings.Split(line, ",") {
+			alg, _, _ := strings.Cut(strings.TrimSpace(v), "=")
+
+			var sum []byte
+			switch strings.ToUpper(alg) {
+			case "MD5":
+				s := md5.Sum(body)
+				sum = s[:]
+			case "SHA-256":
+				s := sha256.Sum256(body)
+				sum = s[:]
+			case "SHA-512":
+				s := sha512.Sum512(body)
+				sum = s[:]
+			default:
+				continue
+			}
+
+			digests = append(digests, alg+"="+base64.StdEncoding.EncodeToString(sum))
+		}
+	}
+
+	if digests == nil {
+		delete(hdr, "Digest")
+	} else {
+		hdr["Digest"] = []string{strings.Join(digests, ", ")}
+	}
+}
+
+// mergeVary merges the Vary header with Accept-Encoding.
+// Field names repeated by the handler, whether with Set or
+// Add and in any case, are listed only once, and a Vary of
+// * replaces every other field name.
+func mergeVary(hdr http.Header) {
+	seen := map[string]bool{"accept-encoding": false}
+
+	var vary []string
+	for _, line := range hdr["Vary"] {
+		var names []string
+		for _, name := range strings.Split(line, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				hdr["Vary"] = []string{"*"}
+				return
+			}
+
+			key := strings.ToLower(name)
+			if name == "" || seen[key] {
+				continue
+			}
+
+			seen[key] = true
+			names = append(names, name)
+		}
+
+		if names != nil {
+			vary = append(vary, strings.Join(names, ", "))
+		}
+	}
+
+	if !seen["accept-encoding"] {
+		vary = append(vary, "Accept-Encoding")
+	}
+
+	hdr["Vary"] = vary
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The connection of an upgraded request is taken over
+	// by another protocol, so nothing may be buffered or
+	// compressed.
+	if isUpgrade(r) {
+		h.Handler.ServeHTTP(w, r)
+		return
+	}
+
+	mergeVary(w.Header())
+
+	var encoding string
+	encoding, r = negotiateRequest(r, h.assumeGzip)
+	acceptsGzip := encoding != ""
+
+	gw := &responseWriter{
+		ResponseWriter: w,
+
+		h: h,
+
+		r: r,
+
+		encoding: encoding,
+
+		code: http.StatusOK,
+	}
+
+	// A range request, with or without If-Range, is
+	// answered with either part or all of the handler's
+	// representation, which must be left untouched for
+	// the client to combine it with what it already has.
+	_, isRange := r.Header["Range"]
+
+	isHTTP10 := r.ProtoMajor == 1 && r.ProtoMinor == 0
+	switch {
+	case !acceptsGzip,
+		isRange,
+		isHTTP10 && h.http10Mode == HTTP10PassThrough,
+		h.skipLocalhost && isLoopback(r),
+		h.debugDisabled(r):
+		// The response is never compressed, but it is
+		// still wrapped to preserve the Vary header.
+		gw.state = writerStatePassThrough
+		gw.reason = ReasonDenied
+		if !acceptsGzip {
+			gw.reason = ReasonNotAccepted
+		}
+	case isHTTP10 && h.http10Mode == HTTP10Buffer:
+		gw.compressed = new(bytes.Buffer)
+		gw.wantDigest = h.emitDigest && wantsContentDigest(r.Header)
+		fallthrough
+	default:
+		gw.state = writerStateInitial
+
+		// A negative MinSizeFunc result falls back to
+		// MinSize rather than failing the request.
+		gw.minSize = h.minSize
+		if h.minSizeFunc != nil {
+			if minSize := h.minSizeFunc(r); minSize >= 0 {
+				gw.minSize = minSize
+			} else if h.onError != nil {
+				h.onError(r, ErrNegativeMinSize)
+			}
+		}
+
+		// Matched routes are expected to be large, so the
+		// decision is made on the first write rather than
+		// after buffering minSize bytes.
+		if h.alwaysCompress(r) {
+			gw.minSize = 0
+		}
+
+		// An invalid LevelUnderPressure result falls back
+		// to Level rather than failing the request.
+		gw.pool = h.pool
+		if h.levelUnderPressure != nil {
+			if level := h.levelUnderPressure(); validLevel(level) {
+				gw.pool = h.levelPools[level-DefaultCompression]
+			} else if h.onError != nil {
+				h.onError(r, ErrInvalidLevel)
+			}
+		}
+	}
+	if h.stats != nil {
+		defer gw.reportStats()
+	}
+	if h.auditLog != nil {
+		defer gw.writeAuditLog()
+	}
+	defer func() {
+		// The handler usually leaves the response to be
+		// closed here, so the error would otherwise be
+		// lost.
+		if err := gw.Close(); err != nil && h.onError != nil {
+			h.onError(r, err)
+		}
+	}()
+
+	rw := wrapResponseWriter(gw, w, h.onPush)
+	h.Handler.ServeHTTP(rw, r)
+}
+
+// alwaysCompress reports whether the request path matches
+// one of Options.AlwaysCompressRoutes.
+func (h *handler) alwaysCompress(r *http.Request) bool {
+	for _, pattern := range h.alwaysCompressRoutes {
+		// The patterns were checked by Validate.
+		if ok, _ := path.Match(pattern, r.URL.Path); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// debugDisabled reports whether compression was disabled
+// for the request with Options.DebugDisableParam or
+// Options.DebugDisableCookie.
+func (h *handler) debugDisabled(r *http.Request) bool {
+	if h.debugDisableParam != "" && r.URL.Query().Has(h.debugDisableParam) {
+		return true
+	}
+
+	if h.debugDisableCookie != "" {
+		if _, err := r.Cookie(h.debugDisableCookie); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newGzipWriter is the default Options.NewWriter, which
+// returns a *gzip.Writer.
+func newGzipWriter(w io.Writer, level int) (GzipWriter, error) {
+	return gzip.NewWriterLevel(w, level)
+}
+
+// Gzip wraps an HTTP handler, to transparently gzip the
 // response body if the client supports it (via the
 // Accept-Encoding header). This will compress at the
 // default compression level. The resource will not be
 // compressed unless it exceeds 512 bytes.
+//
+// A response that already has a Content-Encoding is never
+// compressed, so gzip is always the first coding listed.
+// Middleware wrapping the returned handler that applies a
+// further coding, such as encryption, should append it to
+// the Content-Encoding header rather than replace it.
+//
+// Multipart responses, such as the
+// multipart/x-mixed-replace stream of an MJPEG camera, are
+// never buffered or compressed, so each part reaches the
+// client as soon as it is flushed. The Content-Type must
+// be set before the first write.
+//
+// When used with http.TimeoutHandler, the handler
+// returned by Gzip should wrap it, as in
+// Gzip(http.TimeoutHandler(h, dt, msg)), rather than be
+// wrapped by it. http.TimeoutHandler buffers the response
+// in full anyway, so it is then compressed once, with a
+// known length, after h returns. Wrapped the other way,
+// the response is compressed into a buffer that is thrown
+// away if h times out.
 func Gzip(h http.Handler) http.Handler {
 	return GzipWithLevel(h, gzip.DefaultCompression)
 }
@@ -354,89 +2066,382 @@ func GzipWithOptions(h http.Handler, opts *Options) http.Handler {
 		panic("GzipWithOptions used with nil *Options argument")
 	}
 
-	if opts.Level != gzip.DefaultCompression &&
-		(opts.Level < gzip.BestSpeed || opts.Level > gzip.BestCompression) {
-		panic("invalid compression level requested")
+	if err := opts.Validate(); err != nil {
+		panic(err)
+	}
+
+	newWriter := opts.NewWriter
+	if newWriter == nil {
+		newWriter = newGzipWriter
+	}
+
+	level, minSize := opts.Level, opts.MinSize
+	pool := newWriterPool(newWriter, level)
+	if opts.WriterPool != nil {
+		pool.pool = opts.WriterPool
+	}
+
+	var levelPools []*writerPool
+	if opts.LevelUnderPressure != nil {
+		levelPools = make([]*writerPool, BestCompression-DefaultCompression+1)
+		for i := range levelPools {
+			levelPools[i] = newWriterPool(newWriter, i+DefaultCompression)
+		}
+
+		levelPools[level-DefaultCompression] = pool
+	}
+
+	var estimateHeader string
+	if opts.EstimateHeader != "" {
+		estimateHeader = http.CanonicalHeaderKey(opts.EstimateHeader)
+	}
+
+	var sem chan struct{}
+	if opts.MaxConcurrent > 0 {
+		sem = make(chan struct{}, opts.MaxConcurrent)
+	}
+
+	var cacheID string
+	if opts.CompressedCache != nil {
+		cacheID = strconv.FormatUint(atomic.AddUint64(&handlerCacheIDs, 1), 10)
 	}
 
-	if opts.MinSize < 0 {
-		panic("minimum size must be more than zero")
+	var streamBufferPool *sync.Pool
+	if size := opts.StreamBufferSize; size > 0 {
+		streamBufferPool = &sync.Pool{
+			New: func() interface{} {
+				return &streamBuffer{buf: make([]byte, 0, size)}
+			},
+		}
 	}
 
-	level := opts.Level
 	return &handler{
 		Handler: h,
 
-		pool: &sync.Pool{
+		pool: pool,
+
+		levelPools: levelPools,
+
+		levelUnderPressure: opts.LevelUnderPressure,
+
+		streamBufferPool: streamBufferPool,
+
+		bufferPool: &sync.Pool{
 			New: func() interface{} {
-				w, err := gzip.NewWriterLevel(nil, level)
-				if err != nil {
-					panic(err)
+				// Responses are only buffered until they
+				// reach minSize, so a buffer of this
+				// capacity rarely needs to grow.
+				size := minSize
+				if size > maxPooledBufferSize {
+					size = maxPooledBufferSize
 				}
-
-				return w
+				buf := make([]byte, 0, size)
+				return &buf
 			},
 		},
 
-		minSize: opts.MinSize,
+		minSize: minSize,
+
+		minSizeFunc: opts.MinSizeFunc,
 
 		canCompress: opts.CanCompress,
+
+		canCompressFull: opts.CanCompressFull,
+
+		onlyCacheable: opts.OnlyCacheable,
+
+		emitUncompressedLength: opts.EmitUncompressedLength,
+
+		uncompressedLengthTrailer: opts.UncompressedLengthTrailer,
+
+		decisionWindow: opts.DecisionWindow,
+
+		bufferForContentLength: opts.BufferForContentLength,
+
+		synchronized: opts.Synchronized,
+
+		disableContentTypeSniff: opts.DisableContentTypeSniff,
+
+		http10Mode: opts.HTTP10Mode,
+
+		gzipOS: opts.GzipOS,
+
+		gzipExtra: opts.GzipExtra,
+
+		sniffText: opts.SniffText,
+
+		flushOnClose: opts.FlushOnClose,
+
+		stats: opts.Stats,
+
+		noBuffer: opts.NoBuffer,
+
+		skipLocalhost: opts.SkipLocalhost,
+
+		auditLog: opts.AuditLog,
+
+		tap: opts.Tap,
+
+		sampleRatio: opts.SampleRatio,
+
+		onPush: opts.OnPush,
+
+		assumeGzip: opts.AssumeGzip,
+
+		skipAttachments: opts.SkipAttachments,
+
+		skipScriptTypes: opts.SkipScriptTypes,
+
+		skipOnSetCookie: opts.SkipOnSetCookie,
+
+		alwaysCompressRoutes: opts.AlwaysCompressRoutes,
+
+		alwaysCompressTypes: normalizeMediaTypes(opts.AlwaysCompressTypes),
+
+		cache: opts.CompressedCache,
+
+		cacheID: cacheID,
+
+		flushOnNewline: opts.FlushOnNewline,
+
+		padding: opts.Padding,
+
+		debugDisableParam: opts.DebugDisableParam,
+
+		debugDisableCookie: opts.DebugDisableCookie,
+
+		sem: sem,
+
+		contentTypeRewrite: opts.ContentTypeRewrite,
+
+		maxCompressInput: opts.MaxCompressInput,
+
+		onError: opts.OnError,
+
+		estimateHeader: estimateHeader,
+
+		optIn: opts.OptIn,
+
+		debugHeader: opts.DebugHeader,
+
+		emitDigest: opts.EmitDigest,
+
+		recomputeDigest: opts.RecomputeDigest,
 	}
 }
 
-// Options is a struct that defines options to customise
-// the behaviour of the gzip handler.
-type Options struct {
-	// Level is the gzip compression level to apply.
-	// See the level constants defined in this package.
-	//
-	// The default value adds gzip framing but performs
-	// no compression.
-	Level int
+// handlerCacheIDs is the last ID given to a handler with
+// Options.CompressedCache, see compressedCacheKey.
+var handlerCacheIDs uint64
 
-	// MinSize specifies the minimum size of a response
-	// before it will be compressed. Responses smaller
-	// than this value will not be compressed.
-	//
-	// If MinSize is zero, all responses will be
-	// compressed.
-	MinSize int
+// writerPool is a pool of GzipWriters with the same
+// compression level.
+type writerPool struct {
+	pool *sync.Pool
 
-	// CanCompress can be set to a function to conditionally
-	// compress the data stream. Usually, the function will
-	// read the Content-Type header to determine whether
-	// it makes sense to compress the data.
-	CanCompress func(http.Header) bool
+	newWriter func(io.Writer, int) (GzipWriter, error)
+	level     int
 }
 
-type responseWriterFlusher interface {
-	http.ResponseWriter
-	http.Flusher
+// newWriterPool returns a pool of GzipWriters created by
+// newWriter with the given compression level.
+func newWriterPool(newWriter func(io.Writer, int) (GzipWriter, error), level int) *writerPool {
+	return &writerPool{
+		pool:      new(sync.Pool),
+		newWriter: newWriter,
+		level:     level,
+	}
 }
 
-type closeNotifyResponseWriter struct {
-	responseWriterFlusher
-	http.CloseNotifier
+// Get returns a GzipWriter from the pool, or creates one
+// if the pool is empty. Unlike sync.Pool.New, which could
+// only panic, it returns the error from NewWriter.
+func (p *writerPool) Get() (GzipWriter, error) {
+	switch gw := p.pool.Get().(type) {
+	case nil:
+		return p.newWriter(nil, p.level)
+	case GzipWriter:
+		return gw, nil
+	default:
+		// Only possible with Options.WriterPool.
+		return nil, ErrInvalidPooledWriter
+	}
 }
 
-type hijackResponseWriter struct {
-	responseWriterFlusher
-	http.Hijacker
+// Put adds gw to the pool.
+func (p *writerPool) Put(gw GzipWriter) {
+	p.pool.Put(gw)
 }
 
-type pusherResponseWriter struct {
-	responseWriterFlusher
-	http.Pusher
+// replayWriter is a GzipWriter that discards the data
+// written to it and instead writes a response compressed
+// earlier, from Options.CompressedCache, when closed.
+type replayWriter struct {
+	w    io.Writer
+	body []byte
+}
+
+func (rw *replayWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (rw *replayWriter) Flush() error {
+	return nil
+}
+
+func (rw *replayWriter) Close() error {
+	_, err := rw.w.Write(rw.body)
+	return err
+}
+
+func (rw *replayWriter) Reset(w io.Writer) {
+	rw.w = w
+}
+
+// recordingWriter records a copy of the compressed
+// response written through it to be cached. The copy is
+// discarded once it exceeds limit.
+type recordingWriter struct {
+	io.Writer
+
+	buf       []byte
+	limit     int64
+	discarded bool
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	n, err := rw.Writer.Write(b)
+
+	if !rw.discarded {
+		if int64(len(rw.buf)+n) > rw.limit {
+			rw.buf, rw.discarded = nil, true
+		} else {
+			rw.buf = append(rw.buf, b[:n]...)
+		}
+	}
+
+	return n, err
+}
+
+// streamBuffer is a fixed size buffer in front of w, see
+// Options.StreamBufferSize. Unlike a bufio.Writer, it
+// never writes more than its size to w at once, even for
+// large writes.
+type streamBuffer struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (sb *streamBuffer) Write(p []byte) (int, error) {
+	var n int
+	for len(p) != 0 {
+		m := copy(sb.buf[len(sb.buf):cap(sb.buf)], p)
+		sb.buf = sb.buf[:len(sb.buf)+m]
+		n += m
+		p = p[m:]
+
+		if len(sb.buf) == cap(sb.buf) {
+			if err := sb.Flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+
+	return n, nil
 }
 
-type closeNotifyHijackResponseWriter struct {
-	responseWriterFlusher
-	http.CloseNotifier
-	http.Hijacker
+// Flush writes the buffered data to w.
+func (sb *streamBuffer) Flush() error {
+	if len(sb.buf) == 0 {
+		return nil
+	}
+
+	_, err := sb.w.Write(sb.buf)
+	sb.buf = sb.buf[:0]
+	return err
 }
 
-type closeNotifyPusherResponseWriter struct {
-	responseWriterFlusher
-	http.CloseNotifier
+// hookPusher is an http.Pusher that calls a hook before
+// initiating each push.
+type hookPusher struct {
 	http.Pusher
+
+	hook func(target string, opts *http.PushOptions)
+}
+
+func (p *hookPusher) Push(target string, opts *http.PushOptions) error {
+	if opts == nil {
+		opts = new(http.PushOptions)
+	}
+
+	p.hook(target, opts)
+	return p.Pusher.Push(target, opts)
+}
+
+type responseWriterFlusher interface {
+	ResponseWriter
+	io.ReaderFrom
+	Unwrap() http.ResponseWriter
+}
+
+// wrapResponseWriter returns rw extended with whichever of
+// http.CloseNotifier, http.Hijacker and http.Pusher the
+// underlying w implements, so that handlers see the same
+// optional interfaces with or without compression. Pushes
+// are reported to onPush first, if it is not nil.
+//
+// Optional interfaces not listed here remain reachable with
+// http.ResponseController, through rw's Unwrap method.
+func wrapResponseWriter(rw responseWriterFlusher, w http.ResponseWriter, onPush func(target string, opts *http.PushOptions)) http.ResponseWriter {
+	c, cok := w.(http.CloseNotifier)
+	hj, hok := w.(http.Hijacker)
+	p, pok := w.(http.Pusher)
+	if pok && onPush != nil {
+		p = &hookPusher{p, onPush}
+	}
+
+	switch {
+	case cok && hok && pok:
+		return &struct {
+			responseWriterFlusher
+			http.CloseNotifier
+			http.Hijacker
+			http.Pusher
+		}{rw, c, hj, p}
+	case cok && hok:
+		return &struct {
+			responseWriterFlusher
+			http.CloseNotifier
+			http.Hijacker
+		}{rw, c, hj}
+	case cok && pok:
+		return &struct {
+			responseWriterFlusher
+			http.CloseNotifier
+			http.Pusher
+		}{rw, c, p}
+	case hok && pok:
+		return &struct {
+			responseWriterFlusher
+			http.Hijacker
+			http.Pusher
+		}{rw, hj, p}
+	case cok:
+		return &struct {
+			responseWriterFlusher
+			http.CloseNotifier
+		}{rw, c}
+	case hok:
+		return &struct {
+			responseWriterFlusher
+			http.Hijacker
+		}{rw, hj}
+	case pok:
+		return &struct {
+			responseWriterFlusher
+			http.Pusher
+		}{rw, p}
+	default:
+		return rw
+	}
 }
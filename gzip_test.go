@@ -1,17 +1,36 @@
+//go:build !nogzip
+// +build !nogzip
+
 package gziphandler
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"net/http/httputil"
 	"net/url"
+	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"testing/iotest"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -76,6 +95,391 @@ func TestGzipHandlerAcceptEncodingCaseInsensitive(t *testing.T) {
 	assert.Equal(t, gzipStrLevel(testBody, gzip.DefaultCompression), resp.Body.Bytes())
 }
 
+func TestGzipHandlerVaryReplaced(t *testing.T) {
+	for _, acceptEncoding := range []string{"", "gzip"} {
+		for _, body := range []string{"test", testBody} {
+			handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Vary", "Accept")
+				io.WriteString(w, body)
+			}))
+
+			req, _ := http.NewRequest("GET", "/whatever", nil)
+			if acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", acceptEncoding)
+			}
+			resp := httptest.NewRecorder()
+			handler.ServeHTTP(resp, req)
+			res := resp.Result()
+
+			assert.Equal(t, []string{"Accept", "Accept-Encoding"}, res.Header["Vary"],
+				"for Accept-Encoding %q and body of length %d", acceptEncoding, len(body))
+		}
+	}
+}
+
+func TestPassThroughEmptyBody(t *testing.T) {
+	handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Vary", "Accept")
+		w.Header().Set("X-Estimated-Size", "10000")
+		w.Header().Set(OptInHeader, "1")
+	}), &Options{
+		Level:          DefaultCompression,
+		MinSize:        defaultMinSize,
+		EstimateHeader: "X-Estimated-Size",
+		OptIn:          true,
+		DebugHeader:    true,
+	})
+
+	// Without an Accept-Encoding header, the response is
+	// passed through from the start.
+	req, _ := http.NewRequest("GET", "/whatever", nil)
+	resp := &headerSnapshotRecorder{ResponseRecorder: httptest.NewRecorder()}
+	handler.ServeHTTP(resp, req)
+
+	if assert.NotNil(t, resp.snapshot) {
+		assert.Equal(t, []string{"Accept", "Accept-Encoding"}, resp.snapshot["Vary"])
+		assert.Equal(t, "passthrough", resp.snapshot.Get("X-Compression"))
+		_, estimate := resp.snapshot["X-Estimated-Size"]
+		assert.False(t, estimate)
+		_, optIn := resp.snapshot[OptInHeader]
+		assert.False(t, optIn)
+	}
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Empty(t, resp.Body.String())
+}
+
+func TestGzipHandlerVaryMerged(t *testing.T) {
+	for _, test := range []struct {
+		vary   func(hdr http.Header)
+		expect []string
+	}{
+		{func(hdr http.Header) {
+			hdr.Add("Vary", "Accept")
+		}, []string{"Accept-Encoding", "Accept"}},
+		{func(hdr http.Header) {
+			hdr.Add("Vary", "accept-encoding")
+		}, []string{"Accept-Encoding"}},
+		{func(hdr http.Header) {
+			hdr.Set("Vary", "Accept, Accept-Encoding")
+			hdr.Add("Vary", "Origin, Accept")
+		}, []string{"Accept, Accept-Encoding", "Origin"}},
+		{func(hdr http.Header) {
+			hdr.Set("Vary", "Origin")
+			hdr.Add("Vary", "Accept-Encoding, Origin")
+		}, []string{"Origin", "Accept-Encoding"}},
+		{func(hdr http.Header) {
+			hdr.Add("Vary", "Origin")
+			hdr.Add("Vary", "*")
+		}, []string{"*"}},
+	} {
+		for _, body := range []string{"test", testBody} {
+			handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				test.vary(w.Header())
+				io.WriteString(w, body)
+			}))
+
+			req, _ := http.NewRequest("GET", "/whatever", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			resp := httptest.NewRecorder()
+			handler.ServeHTTP(resp, req)
+
+			assert.Equal(t, test.expect, resp.Result().Header["Vary"],
+				"for body of length %d", len(body))
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	for _, test := range []struct {
+		acceptEncoding string
+		expect         string
+	}{
+		{"gzip", "gzip"},
+		{"gzip, deflate", "gzip"},
+		{"gzip, deflate, br", "gzip"},
+		{"deflate, gzip", "gzip"},
+		{"br;q=1.0, gzip;q=0.8", "gzip"},
+		{"GZIP", "GZIP"},
+		{"gzip;q=0", ""},
+		{"deflate, br", ""},
+		{"deflate", ""},
+		{"deflate;q=1.0, gzip;q=0.5", "gzip"},
+		{"identity", ""},
+		{"", ""},
+		{"gzip;q=0.001", "gzip"},
+		{"gzip;q=0.001, identity", ""},
+		{"identity, gzip;q=0.001", ""},
+		{"gzip;q=0.5, identity;q=0.5", "gzip"},
+		{"identity;q=0.5, gzip;q=0.8", "gzip"},
+		{"identity;q=0, gzip;q=0.001", "gzip"},
+		{"gzip;q=0, identity", ""},
+		{"*", "gzip"},
+		{"br, *;q=0.5", "gzip"},
+		{"*;q=0", ""},
+		{"*, gzip;q=0", ""},
+		{"*;q=0.5, identity", ""},
+		{"x-gzip", "x-gzip"},
+		{"X-GZIP;q=0.5", "X-GZIP"},
+	} {
+		hdr := make(http.Header)
+		if test.acceptEncoding != "" {
+			hdr.Set("Accept-Encoding", test.acceptEncoding)
+		}
+
+		assert.Equal(t, test.expect, negotiate(hdr), "for Accept-Encoding %q", test.acceptEncoding)
+	}
+
+	hdr := http.Header{"Accept-Encoding": {"gzip, deflate, br"}}
+	allocs := testing.AllocsPerRun(100, func() {
+		negotiate(hdr)
+	})
+	assert.Equal(t, 0.0, allocs, "negotiate allocated for %q", hdr.Get("Accept-Encoding"))
+}
+
+func TestNegotiatePublic(t *testing.T) {
+	for _, test := range []struct {
+		acceptEncoding []string
+		offered        []string
+		chosen         string
+		acceptable     bool
+	}{
+		// The examples of RFC 9110 section 12.5.3.
+		{[]string{"compress, gzip"}, []string{"gzip", "compress"}, "gzip", true},
+		{[]string{"compress, gzip"}, []string{"br"}, "identity", true},
+		{[]string{""}, []string{"gzip"}, "identity", true},
+		{[]string{"*"}, []string{"br", "gzip"}, "br", true},
+		{[]string{"compress;q=0.5, gzip;q=1.0"}, []string{"compress", "gzip"}, "gzip", true},
+		{[]string{"gzip;q=1.0, identity; q=0.5, *;q=0"}, []string{"br", "gzip"}, "gzip", true},
+		{[]string{"gzip;q=1.0, identity; q=0.5, *;q=0"}, []string{"br"}, "identity", true},
+
+		// No Accept-Encoding header.
+		{nil, []string{"gzip"}, "identity", true},
+
+		// Ordering and ties.
+		{[]string{"gzip, br"}, []string{"br", "gzip"}, "br", true},
+		{[]string{"gzip;q=0.8, br;q=0.9"}, []string{"gzip", "br"}, "br", true},
+		{[]string{"gzip;q=0.5, *;q=0.8"}, []string{"gzip", "br"}, "br", true},
+		{[]string{"*;q=0.5, gzip"}, []string{"br", "gzip"}, "gzip", true},
+		{[]string{"gzip", "br;q=0.5"}, []string{"br", "gzip"}, "gzip", true},
+
+		// Case-insensitivity and aliases.
+		{[]string{"GZIP"}, []string{"gzip"}, "gzip", true},
+		{[]string{"x-gzip"}, []string{"gzip"}, "gzip", true},
+		{[]string{"gzip"}, []string{"x-gzip"}, "x-gzip", true},
+		{[]string{"gzip"}, []string{"GZip"}, "GZip", true},
+		{[]string{"Identity;q=0"}, []string{"br"}, "identity", false},
+
+		// Unacceptable codings.
+		{[]string{"gzip;q=0"}, []string{"gzip"}, "identity", true},
+		{[]string{"*, gzip;q=0"}, []string{"gzip", "br"}, "br", true},
+		{[]string{"deflate"}, nil, "identity", true},
+
+		// Identity.
+		{[]string{"identity;q=0"}, []string{"gzip"}, "identity", false},
+		{[]string{"identity;q=0, gzip"}, []string{"gzip"}, "gzip", true},
+		{[]string{"*;q=0"}, []string{"gzip"}, "identity", false},
+		{[]string{"*;q=0, identity"}, []string{"gzip"}, "identity", true},
+		{[]string{"*;q=0, gzip"}, []string{"gzip"}, "gzip", true},
+		{[]string{"gzip;q=0.5, identity"}, []string{"gzip"}, "identity", true},
+		{[]string{"gzip;q=0.5, identity;q=0.5"}, []string{"gzip"}, "gzip", true},
+		{[]string{"gzip;q=0.001"}, []string{"gzip"}, "gzip", true},
+		{[]string{"br, identity;q=0.5"}, []string{"identity", "gzip"}, "identity", true},
+	} {
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		if test.acceptEncoding != nil {
+			req.Header["Accept-Encoding"] = test.acceptEncoding
+		}
+
+		chosen, acceptable := Negotiate(req, test.offered)
+		assert.Equal(t, test.chosen, chosen, "for Accept-Encoding %q and offered %q", test.acceptEncoding, test.offered)
+		assert.Equal(t, test.acceptable, acceptable, "for Accept-Encoding %q and offered %q", test.acceptEncoding, test.offered)
+	}
+}
+
+func TestNegotiateAgrees(t *testing.T) {
+	for _, acceptEncoding := range []string{
+		"gzip", "GZIP", "x-gzip", "gzip;q=0", "deflate", "identity", "",
+		"*", "*;q=0", "br, *;q=0.5", "*, gzip;q=0", "*;q=0.5, identity",
+		"gzip;q=0.5, identity", "gzip;q=0.5, identity;q=0.5",
+		"identity;q=0, gzip;q=0.001",
+	} {
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+
+		chosen, _ := Negotiate(req, []string{"gzip"})
+		assert.Equal(t, chosen == "gzip", negotiate(req.Header) != "", "for Accept-Encoding %q", acceptEncoding)
+	}
+}
+
+func TestNegotiatedEncoding(t *testing.T) {
+	var innerReq, handlerReq *http.Request
+	inner := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerReq = r
+		io.WriteString(w, testBody)
+	}))
+	outer := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		innerReq = r
+		inner.ServeHTTP(w, r)
+	}))
+
+	for _, test := range []struct {
+		acceptEncoding string
+		encoding       string
+	}{
+		{"gzip", "gzip"},
+		{"GZIP;q=0.5", "GZIP"},
+		{"identity", ""},
+	} {
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", test.acceptEncoding)
+
+		_, ok := NegotiatedEncoding(req)
+		assert.False(t, ok, "for Accept-Encoding %q", test.acceptEncoding)
+
+		resp := httptest.NewRecorder()
+		outer.ServeHTTP(resp, req)
+
+		// The result is only cached if the client
+		// accepts gzip.
+		encoding, ok := NegotiatedEncoding(handlerReq)
+		assert.Equal(t, test.encoding != "", ok, "for Accept-Encoding %q", test.acceptEncoding)
+		assert.Equal(t, test.encoding, encoding, "for Accept-Encoding %q", test.acceptEncoding)
+
+		// The inner handler reused the result of the outer
+		// handler rather than negotiating again.
+		assert.True(t, innerReq == handlerReq, "for Accept-Encoding %q", test.acceptEncoding)
+
+		// The response is only compressed once.
+		if test.encoding != "" {
+			assert.Equal(t, []string{"gzip"}, resp.Header()["Content-Encoding"], "for Accept-Encoding %q", test.acceptEncoding)
+			assert.Equal(t, testBody, string(MustGunzip(resp.Body.Bytes())), "for Accept-Encoding %q", test.acceptEncoding)
+		}
+	}
+
+	// The cached result is discarded if the header is
+	// modified.
+	req, _ := http.NewRequest("GET", "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	outer.ServeHTTP(httptest.NewRecorder(), req)
+
+	handlerReq.Header.Set("Accept-Encoding", "GZIP")
+	_, ok := NegotiatedEncoding(handlerReq)
+	assert.False(t, ok)
+
+	encoding, r := negotiateRequest(handlerReq, false)
+	assert.Equal(t, "GZIP", encoding)
+	assert.False(t, r == handlerReq)
+}
+
+func TestNegotiatedEncodingAssumeGzip(t *testing.T) {
+	var handlerReq *http.Request
+	handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerReq = r
+		io.WriteString(w, testBody)
+	}), &Options{
+		Level:      DefaultCompression,
+		MinSize:    defaultMinSize,
+		AssumeGzip: true,
+	})
+
+	req, _ := http.NewRequest("GET", "/whatever", nil)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	// The response is compressed, so middleware must not
+	// be told the client doesn't accept gzip.
+	assert.Equal(t, "gzip", resp.Header().Get("Content-Encoding"))
+	encoding, ok := NegotiatedEncoding(handlerReq)
+	assert.True(t, ok)
+	assert.Equal(t, "gzip", encoding)
+}
+
+func TestCanonicalEncoding(t *testing.T) {
+	for _, test := range []struct {
+		enc, expect string
+	}{
+		{"gzip", "gzip"},
+		{"GZIP", "gzip"},
+		{"GZip", "gzip"},
+		{"gZiP", "gzip"},
+		{"x-gzip", "gzip"},
+		{"X-GZIP", "gzip"},
+		{"Deflate", "deflate"},
+	} {
+		assert.Equal(t, test.expect, canonicalEncoding(test.enc), "for %q", test.enc)
+	}
+
+	for _, enc := range []string{"GZIP", "Gzip", "gzIP"} {
+		handler := newTestHandler(testBody)
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", enc)
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		res := resp.Result()
+
+		assert.Equal(t, []string{"gzip"}, res.Header["Content-Encoding"], "for %q", enc)
+	}
+}
+
+func TestDeflateOnly(t *testing.T) {
+	for _, assumeGzip := range []bool{false, true} {
+		for _, ae := range []string{"deflate", "Deflate", "deflate, br", "deflate;q=1.0, gzip;q=0"} {
+			handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, testBody)
+			}), &Options{
+				Level:      DefaultCompression,
+				MinSize:    defaultMinSize,
+				AssumeGzip: assumeGzip,
+			})
+
+			req, _ := http.NewRequest("GET", "/whatever", nil)
+			req.Header.Set("Accept-Encoding", ae)
+			resp := httptest.NewRecorder()
+			handler.ServeHTTP(resp, req)
+			res := resp.Result()
+
+			assert.Empty(t, res.Header.Get("Content-Encoding"), "for Accept-Encoding %q", ae)
+			assert.Equal(t, testBody, resp.Body.String(), "for Accept-Encoding %q", ae)
+		}
+	}
+}
+
+func TestAssumeGzip(t *testing.T) {
+	for _, test := range []struct {
+		assumeGzip      bool
+		acceptEncoding  []string
+		contentEncoding string
+	}{
+		{true, nil, "gzip"},
+		{false, nil, ""},
+		{true, []string{""}, ""},
+		{true, []string{}, ""},
+		{true, []string{"identity"}, ""},
+		{true, []string{"gzip;q=0"}, ""},
+		{true, []string{"gzip"}, "gzip"},
+	} {
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, testBody)
+		}), &Options{
+			Level:      DefaultCompression,
+			MinSize:    defaultMinSize,
+			AssumeGzip: test.assumeGzip,
+		})
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		if test.acceptEncoding != nil {
+			req.Header["Accept-Encoding"] = test.acceptEncoding
+		}
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		res := resp.Result()
+
+		assert.Equal(t, test.contentEncoding, res.Header.Get("Content-Encoding"),
+			"for Accept-Encoding %q and AssumeGzip %t", test.acceptEncoding, test.assumeGzip)
+	}
+}
+
 func TestNewGzipLevelHandler(t *testing.T) {
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -96,6 +500,49 @@ func TestNewGzipLevelHandler(t *testing.T) {
 	}
 }
 
+func TestLevelUnderPressure(t *testing.T) {
+	var errs []error
+	level := BestCompression
+	handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testBody)
+	}), &Options{
+		Level:   BestCompression,
+		MinSize: defaultMinSize,
+		LevelUnderPressure: func() int {
+			return level
+		},
+		OnError: func(r *http.Request, err error) {
+			errs = append(errs, err)
+		},
+	})
+
+	for _, lvl := range []int{BestCompression, BestSpeed, DefaultCompression, BestCompression} {
+		level = lvl
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+
+		assert.Equal(t, "gzip", resp.Header().Get("Content-Encoding"), "for level %d", lvl)
+		assert.Equal(t, gzipStrLevel(testBody, lvl), resp.Body.Bytes(), "for level %d", lvl)
+	}
+
+	assert.NotEqual(t, gzipStrLevel(testBody, BestSpeed), gzipStrLevel(testBody, BestCompression))
+
+	assert.Empty(t, errs)
+
+	// An invalid level falls back to Level.
+	level = 42
+	req, _ := http.NewRequest("GET", "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	assert.Equal(t, gzipStrLevel(testBody, BestCompression), resp.Body.Bytes())
+	assert.Equal(t, []error{ErrInvalidLevel}, errs)
+}
+
 func TestGzipHandlerWithLevelReturnsErrorForInvalidLevels(t *testing.T) {
 	assert.Panics(t, func() {
 		GzipWithLevel(nil, -42)
@@ -106,6 +553,74 @@ func TestGzipHandlerWithLevelReturnsErrorForInvalidLevels(t *testing.T) {
 	}, "GzipWithLevel did not panic on invalid level")
 }
 
+func TestInvalidOptionsErrors(t *testing.T) {
+	for _, test := range []struct {
+		opts Options
+		err  error
+	}{
+		{Options{Level: -42}, ErrInvalidLevel},
+		{Options{Level: 42}, ErrInvalidLevel},
+		{Options{Level: DefaultCompression, MinSize: -1}, ErrNegativeMinSize},
+		{Options{Level: DefaultCompression, SampleRatio: -0.5}, ErrNegativeSampleRatio},
+		{Options{Level: DefaultCompression, GzipOS: 100}, ErrInvalidGzipOS},
+		{Options{Level: DefaultCompression, MaxConcurrent: -1}, ErrNegativeMaxConcurrent},
+		{Options{Level: DefaultCompression, AlwaysCompressRoutes: []string{"/api/["}}, ErrInvalidRoutePattern},
+		{Options{Level: DefaultCompression, GzipExtra: make([]byte, 0x10000)}, ErrGzipExtraTooLong},
+		{Options{Level: DefaultCompression, MinSize: 20, EnforceMinRecommended: true}, ErrMinSizeTooSmall},
+	} {
+		assertPanicsWith(t, test.err, func() {
+			GzipWithOptions(nil, &test.opts)
+		})
+	}
+
+	assertPanicsWith(t, ErrInvalidLevel, func() {
+		GzipWithLevel(nil, 42)
+	})
+	assertPanicsWith(t, ErrNegativeMinSize, func() {
+		GzipWithLevelAndMinSize(nil, DefaultCompression, -10)
+	})
+}
+
+func TestOptionsValidate(t *testing.T) {
+	for _, test := range []struct {
+		opts Options
+		err  error
+	}{
+		{Options{Level: DefaultCompression}, nil},
+		{Options{Level: BestSpeed, MinSize: defaultMinSize}, nil},
+		{Options{Level: BestCompression, SampleRatio: 0.9, GzipOS: 255}, nil},
+		{Options{Level: DefaultCompression, GzipOS: 13}, nil},
+		{Options{}, ErrInvalidLevel},
+		{Options{Level: -2}, ErrInvalidLevel},
+		{Options{Level: 10}, ErrInvalidLevel},
+		{Options{Level: DefaultCompression, MinSize: -1}, ErrNegativeMinSize},
+		{Options{Level: DefaultCompression, SampleRatio: -0.5}, ErrNegativeSampleRatio},
+		{Options{Level: DefaultCompression, GzipOS: 14}, ErrInvalidGzipOS},
+		{Options{Level: DefaultCompression, GzipOS: 254}, ErrInvalidGzipOS},
+		{Options{Level: DefaultCompression, MaxConcurrent: 1}, nil},
+		{Options{Level: DefaultCompression, MinSize: 20}, nil},
+		{Options{Level: DefaultCompression, EnforceMinRecommended: true}, nil},
+		{Options{Level: DefaultCompression, MinSize: MinRecommendedSize, EnforceMinRecommended: true}, nil},
+		{Options{Level: DefaultCompression, MinSize: MinRecommendedSize - 1, EnforceMinRecommended: true}, ErrMinSizeTooSmall},
+		{Options{Level: DefaultCompression, MinSize: 1, EnforceMinRecommended: true}, ErrMinSizeTooSmall},
+		{Options{Level: DefaultCompression, MaxCompressInput: 1 << 20}, nil},
+		{Options{Level: DefaultCompression, MaxCompressInput: -1}, ErrNegativeMaxInput},
+		{Options{Level: DefaultCompression, StreamBufferSize: 4096}, nil},
+		{Options{Level: DefaultCompression, StreamBufferSize: -1}, ErrNegativeStreamBuffer},
+		{Options{Level: DefaultCompression, BufferForContentLength: 1 << 20}, nil},
+		{Options{Level: DefaultCompression, BufferForContentLength: -1}, ErrNegativeLengthBuffer},
+		{Options{Level: DefaultCompression, DecisionWindow: 4096}, nil},
+		{Options{Level: DefaultCompression, DecisionWindow: -1}, ErrNegativeDecisionWindow},
+		{Options{Level: DefaultCompression, MaxConcurrent: -1}, ErrNegativeMaxConcurrent},
+		{Options{Level: DefaultCompression, AlwaysCompressRoutes: []string{"/api/*"}}, nil},
+		{Options{Level: DefaultCompression, AlwaysCompressRoutes: []string{"/api/["}}, ErrInvalidRoutePattern},
+		{Options{Level: DefaultCompression, GzipExtra: make([]byte, 0xffff)}, nil},
+		{Options{Level: DefaultCompression, GzipExtra: make([]byte, 0x10000)}, ErrGzipExtraTooLong},
+	} {
+		assert.Equal(t, test.err, test.opts.Validate(), "for %+v", test.opts)
+	}
+}
+
 func TestGzipHandlerNoBody(t *testing.T) {
 	tests := []struct {
 		statusCode      int
@@ -147,6 +662,7 @@ func TestGzipHandlerNoBody(t *testing.T) {
 		assert.Equal(t, test.contentEncoding, header.Get("Content-Encoding"), fmt.Sprintf("for test iteration %d", num))
 		assert.Equal(t, "Accept-Encoding", header.Get("Vary"), fmt.Sprintf("for test iteration %d", num))
 		assert.Equal(t, test.bodyLen, len(body), fmt.Sprintf("for test iteration %d", num))
+		assert.NotContains(t, header, "Content-Type", fmt.Sprintf("for test iteration %d", num))
 	}
 }
 
@@ -196,106 +712,3178 @@ func TestGzipHandlerContentLength(t *testing.T) {
 	assert.NotEqual(t, b, body)
 }
 
-func TestGzipHandlerMinSize(t *testing.T) {
-	handler := GzipWithLevelAndMinSize(http.HandlerFunc(
-		func(w http.ResponseWriter, r *http.Request) {
-			resp, _ := ioutil.ReadAll(r.Body)
-			w.Write(resp)
-			// Call write multiple times to pass through "chosenWriter"
-			w.Write(resp)
-			w.Write(resp)
-		},
-	), gzip.DefaultCompression, 13)
+func TestGzipHandlerDeclaredContentLength(t *testing.T) {
+	for _, test := range []struct {
+		name            string
+		contentLength   int
+		body            string
+		contentEncoding string
+		buffered        bool
+	}{
+		{"declared-large", len(testBody), testBody, "gzip", false},
+		{"declared-small", len("test"), "test", "", false},
+		{"absent", -1, testBody, "gzip", true},
+	} {
+		resp := httptest.NewRecorder()
 
-	// Run a test with size smaller than the limit
-	b := bytes.NewBufferString("test")
+		var buffered bool
+		handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if test.contentLength >= 0 {
+				w.Header().Set("Content-Length", strconv.Itoa(test.contentLength))
+			}
 
-	req1, _ := http.NewRequest("GET", "/whatever", b)
-	req1.Header.Add("Accept-Encoding", "gzip")
-	resp1 := httptest.NewRecorder()
-	handler.ServeHTTP(resp1, req1)
-	res1 := resp1.Result()
+			io.WriteString(w, test.body[:2])
+			buffered = resp.Body.Len() == 0
+			io.WriteString(w, test.body[2:])
+		}))
 
-	if res1.Header.Get("Content-Encoding") == "gzip" {
-		t.Errorf("The response is compress and should not")
-		return
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		handler.ServeHTTP(resp, req)
+		res := resp.Result()
+
+		assert.Equal(t, test.contentEncoding, res.Header.Get("Content-Encoding"), "for %s", test.name)
+		assert.Equal(t, test.buffered, buffered, "for %s", test.name)
+
+		if test.contentEncoding == "gzip" {
+			assert.Equal(t, test.body, string(MustGunzip(resp.Body.Bytes())), "for %s", test.name)
+		} else {
+			assert.Equal(t, test.body, resp.Body.String(), "for %s", test.name)
+		}
 	}
+}
 
-	// Run a test with size bigger than the limit
-	b = bytes.NewBufferString(smallTestBody)
+func TestMaxCompressInput(t *testing.T) {
+	large := strings.Repeat(testBody, 4)
+	for _, test := range []struct {
+		body            string
+		declared        bool
+		method          string
+		contentEncoding string
+	}{
+		{testBody, true, "GET", "gzip"},
+		{large, true, "GET", ""},
+		{large, false, "GET", "gzip"},
+		{testBody, true, "HEAD", "gzip"},
+		{large, true, "HEAD", ""},
+	} {
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if test.declared {
+				w.Header().Set("Content-Length", strconv.Itoa(len(test.body)))
+			}
+			if r.Method != http.MethodHead {
+				io.WriteString(w, test.body)
+			}
+		}), &Options{
+			Level:            DefaultCompression,
+			MinSize:          defaultMinSize,
+			MaxCompressInput: int64(len(testBody)),
+		})
 
-	req2, _ := http.NewRequest("GET", "/whatever", b)
-	req2.Header.Add("Accept-Encoding", "gzip")
-	resp2 := httptest.NewRecorder()
-	handler.ServeHTTP(resp2, req2)
-	res2 := resp2.Result()
+		req, _ := http.NewRequest(test.method, "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		res := resp.Result()
 
-	if res2.Header.Get("Content-Encoding") != "gzip" {
-		t.Errorf("The response is not compress and should")
-		return
+		assert.Equal(t, test.contentEncoding, res.Header.Get("Content-Encoding"),
+			"for %s of length %d, declared %t", test.method, len(test.body), test.declared)
+		if test.contentEncoding == "" {
+			assert.Equal(t, strconv.Itoa(len(test.body)), res.Header.Get("Content-Length"),
+				"for %s of length %d, declared %t", test.method, len(test.body), test.declared)
+		}
 	}
-
-	assert.Panics(t, func() {
-		GzipWithLevelAndMinSize(nil, gzip.DefaultCompression, -10)
-	}, "GzipWithLevelAndMinSize did not panic on negative minSize")
 }
 
-func TestGzipDoubleClose(t *testing.T) {
-	h := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// call close here and it'll get called again interally by
-		// NewGzipLevelHandler's handler defer
-		w.Write([]byte("test"))
-		w.(io.Closer).Close()
-	}))
+func TestDecisionWindow(t *testing.T) {
+	// A little text followed by random data, which doesn't
+	// compress. The write that reaches MinSize straddles
+	// the two, so the first 512 bytes still look
+	// compressible.
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+	body := append([]byte(strings.Repeat("a", 300)), random...)
 
-	r := httptest.NewRequest("GET", "/", nil)
-	r.Header.Set("Accept-Encoding", "gzip")
-	w := httptest.NewRecorder()
-	h.ServeHTTP(w, r)
+	for _, test := range []struct {
+		window          int
+		contentEncoding string
+	}{
+		{0, "gzip"},
+		{2048, ""},
+	} {
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(body[:300])
+			for data := body[300:]; len(data) != 0; data = data[512:] {
+				w.Write(data[:512])
+			}
+		}), &Options{
+			Level:          DefaultCompression,
+			MinSize:        defaultMinSize,
+			SampleRatio:    0.8,
+			DecisionWindow: test.window,
+		})
 
-	// the second close shouldn't have added the same writer
-	// so we pull out 2 writers from the pool and make sure they're different
-	w1 := h.(*handler).pool.Get()
-	w2 := h.(*handler).pool.Get()
-	// assert.NotEqual looks at the value and not the address, so we use regular ==
-	assert.False(t, w1 == w2)
-}
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
 
-func TestStatusCodes(t *testing.T) {
-	handler := Gzip(http.NotFoundHandler())
-	r := httptest.NewRequest("GET", "/", nil)
-	r.Header.Set("Accept-Encoding", "gzip")
-	w := httptest.NewRecorder()
-	handler.ServeHTTP(w, r)
+		assert.Equal(t, test.contentEncoding, resp.Header().Get("Content-Encoding"), "for DecisionWindow %d", test.window)
 
-	result := w.Result()
-	if result.StatusCode != 404 {
-		t.Errorf("StatusCode should have been 404 but was %d", result.StatusCode)
+		got := resp.Body.Bytes()
+		if test.contentEncoding == "gzip" {
+			got = MustGunzip(got)
+		}
+		assert.Equal(t, body, got, "for DecisionWindow %d", test.window)
 	}
 }
 
-func TestInferContentType(t *testing.T) {
-	handler := GzipWithLevelAndMinSize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		io.WriteString(w, "<!doc")
-		io.WriteString(w, "type html>")
-	}), gzip.DefaultCompression, len("<!doctype html"))
+func TestDecisionWindowEnded(t *testing.T) {
+	for _, test := range []struct {
+		body            string
+		flush           bool
+		contentEncoding string
+	}{
+		{testBody, false, "gzip"},
+		{testBody, true, "gzip"},
+		{smallTestBody, false, ""},
+		{smallTestBody, true, ""},
+	} {
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, test.body)
+			if test.flush {
+				w.(http.Flusher).Flush()
+			}
+		}), &Options{
+			Level:          DefaultCompression,
+			MinSize:        defaultMinSize,
+			DecisionWindow: 4096,
+		})
 
-	req1, _ := http.NewRequest("GET", "/whatever", nil)
-	req1.Header.Add("Accept-Encoding", "gzip")
-	resp1 := httptest.NewRecorder()
-	handler.ServeHTTP(resp1, req1)
-	res1 := resp1.Result()
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
 
-	const expect = "text/html; charset=utf-8"
-	if ct := res1.Header.Get("Content-Type"); ct != expect {
-		t.Error("Infering Content-Type failed for buffered response")
-		t.Logf("Expected: %s", expect)
-		t.Logf("Got:      %s", ct)
+		assert.Equal(t, test.contentEncoding, resp.Header().Get("Content-Encoding"),
+			"for body of length %d and flush %t", len(test.body), test.flush)
+
+		got := resp.Body.Bytes()
+		if test.contentEncoding == "gzip" {
+			got = MustGunzip(got)
+		}
+		assert.Equal(t, test.body, string(got), "for body of length %d and flush %t", len(test.body), test.flush)
 	}
 }
 
-func TestInferContentTypeUncompressed(t *testing.T) {
-	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+func TestEstimateHeader(t *testing.T) {
+	for _, test := range []struct {
+		estimate        string
+		body            string
+		state           writerState
+		contentEncoding string
+	}{
+		{"10000", testBody, writerStateCompress, "gzip"},
+		{strconv.Itoa(defaultMinSize), testBody, writerStateCompress, "gzip"},
+		{"100", testBody, writerStateInitial, "gzip"},
+		{"100", "test", writerStateInitial, ""},
+		{"invalid", testBody, writerStateInitial, "gzip"},
+	} {
+		var state writerState
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Estimated-Size", test.estimate)
+
+			io.WriteString(w, test.body[:2])
+			state = w.(*responseWriter).state
+
+			io.WriteString(w, test.body[2:])
+		}), &Options{
+			Level:          DefaultCompression,
+			MinSize:        defaultMinSize,
+			EstimateHeader: "x-estimated-size",
+		})
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		res := resp.Result()
+
+		body := resp.Body.Bytes()
+		if test.contentEncoding == "gzip" {
+			body = MustGunzip(body)
+		}
+
+		assert.Equal(t, test.state, state, "for estimate %q and body of length %d", test.estimate, len(test.body))
+		assert.Equal(t, test.contentEncoding, res.Header.Get("Content-Encoding"), "for estimate %q and body of length %d", test.estimate, len(test.body))
+		assert.Equal(t, test.body, string(body), "for estimate %q and body of length %d", test.estimate, len(test.body))
+		assert.NotContains(t, res.Header, "X-Estimated-Size", "for estimate %q and body of length %d", test.estimate, len(test.body))
+	}
+}
+
+func TestEmitUncompressedLength(t *testing.T) {
+	handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(testBody)))
+		io.WriteString(w, testBody[:10])
+		io.WriteString(w, testBody[10:])
+	}), &Options{
+		Level:                  DefaultCompression,
+		MinSize:                defaultMinSize,
+		EmitUncompressedLength: true,
+	})
+
+	req, _ := http.NewRequest("GET", "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	res := resp.Result()
+
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, "", res.Header.Get("Content-Length"))
+	assert.Equal(t, strconv.Itoa(len(testBody)), res.Header.Get("X-Uncompressed-Content-Length"))
+	assert.Equal(t, gzipStrLevel(testBody, gzip.DefaultCompression), resp.Body.Bytes())
+}
+
+func TestAcceptRanges(t *testing.T) {
+	for _, test := range []struct {
+		body         string
+		acceptRanges string
+	}{
+		{testBody, ""},
+		{"test", "bytes"},
+	} {
+		handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Accept-Ranges", "bytes")
+			io.WriteString(w, test.body)
+		}))
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		res := resp.Result()
+
+		assert.Equal(t, test.acceptRanges, res.Header.Get("Accept-Ranges"))
+	}
+}
+
+func TestHTTP10Mode(t *testing.T) {
+	for _, test := range []struct {
+		mode            HTTP10Mode
+		contentEncoding string
+		contentLength   bool
+	}{
+		{HTTP10Stream, "gzip", false},
+		{HTTP10PassThrough, "", false},
+		{HTTP10Buffer, "gzip", true},
+	} {
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, testBody)
+		}), &Options{
+			Level:      DefaultCompression,
+			MinSize:    defaultMinSize,
+			HTTP10Mode: test.mode,
+		})
+
+		ln, err := net.Listen("tcp", "127.0.0.1:")
+		if err != nil {
+			t.Fatalf("failed creating listen socket: %v", err)
+		}
+		defer ln.Close()
+		srv := &http.Server{
+			Handler: handler,
+		}
+		go srv.Serve(ln)
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("Unexpected error dialing server: %v", err)
+		}
+		defer conn.Close()
+
+		io.WriteString(conn, "GET / HTTP/1.0\r\nAccept-Encoding: gzip\r\n\r\n")
+
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("Unexpected error reading response: %v", err)
+		}
+		defer res.Body.Close()
+
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatalf("Unexpected error reading response body: %v", err)
+		}
+
+		assert.Empty(t, res.TransferEncoding, "for mode %d", test.mode)
+		assert.Equal(t, test.contentEncoding, res.Header.Get("Content-Encoding"), "for mode %d", test.mode)
+
+		if test.contentLength {
+			assert.Equal(t, strconv.Itoa(len(body)), res.Header.Get("Content-Length"), "for mode %d", test.mode)
+		}
+
+		if test.contentEncoding == "gzip" {
+			assert.Equal(t, gzipStrLevel(testBody, gzip.DefaultCompression), body, "for mode %d", test.mode)
+		} else {
+			assert.Equal(t, testBody, string(body), "for mode %d", test.mode)
+		}
+	}
+}
+
+func TestEmitDigest(t *testing.T) {
+	for _, test := range []struct {
+		protoMinor int
+		body       string
+		want       string
+		digest     bool
+	}{
+		{0, testBody, "sha-256=1", true},
+		{0, testBody, "sha-512=3, sha-256=10", true},
+		{0, testBody, "sha-256=5;x=y", true},
+		{0, testBody, "", false},
+		{0, testBody, "sha-256=0", false},
+		{0, testBody, "sha-512=3", false},
+		{0, "test", "sha-256=1", false},
+		{1, testBody, "sha-256=1", false},
+	} {
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, test.body)
+		}), &Options{
+			Level:      DefaultCompression,
+			MinSize:    defaultMinSize,
+			HTTP10Mode: HTTP10Buffer,
+			EmitDigest: true,
+		})
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.ProtoMinor = test.protoMinor
+		req.Header.Set("Accept-Encoding", "gzip")
+		if test.want != "" {
+			req.Header.Set("Want-Content-Digest", test.want)
+		}
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		res := resp.Result()
+
+		if !test.digest {
+			assert.NotContains(t, res.Header, "Content-Digest",
+				"for HTTP/1.%d, body of length %d and Want-Content-Digest %q", test.protoMinor, len(test.body), test.want)
+			continue
+		}
+
+		sum := sha256.Sum256(resp.Body.Bytes())
+		assert.Equal(t, "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":", res.Header.Get("Content-Digest"),
+			"for Want-Content-Digest %q", test.want)
+		assert.Equal(t, test.body, string(MustGunzip(resp.Body.Bytes())))
+	}
+}
+
+func TestHandlerDigest(t *testing.T) {
+	bodyMD5 := md5.Sum([]byte(testBody))
+	contentMD5 := base64.StdEncoding.EncodeToString(bodyMD5[:])
+
+	for _, test := range []struct {
+		header, value   string
+		recompute       bool
+		protoMinor      int
+		contentEncoding string
+	}{
+		{"Content-MD5", contentMD5, false, 1, ""},
+		{"Digest", "SHA-256=abc", false, 1, ""},
+		{"Content-MD5", contentMD5, true, 1, "gzip"},
+		{"Digest", "SHA-256=abc", true, 1, "gzip"},
+		{"Content-MD5", contentMD5, true, 0, "gzip"},
+		{"Digest", "SHA-256=abc, UNIXsum=30637, md5=xyz", true, 0, "gzip"},
+		{"Digest", "UNIXsum=30637", true, 0, "gzip"},
+	} {
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(test.header, test.value)
+			io.WriteString(w, testBody)
+		}), &Options{
+			Level:           DefaultCompression,
+			MinSize:         defaultMinSize,
+			HTTP10Mode:      HTTP10Buffer,
+			RecomputeDigest: test.recompute,
+		})
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.ProtoMinor = test.protoMinor
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		res := resp.Result()
+
+		msg := fmt.Sprintf("for %s %q, RecomputeDigest %t and HTTP/1.%d", test.header, test.value, test.recompute, test.protoMinor)
+		assert.Equal(t, test.contentEncoding, res.Header.Get("Content-Encoding"), msg)
+
+		body := resp.Body.Bytes()
+		switch {
+		case test.contentEncoding == "":
+			assert.Equal(t, test.value, res.Header.Get(test.header), msg)
+			assert.Equal(t, testBody, string(body), msg)
+		case test.protoMinor == 1:
+			// The digests of a streamed response can't be
+			// computed before it is sent.
+			assert.Empty(t, res.Header.Values(test.header), msg)
+		case test.header == "Content-MD5":
+			sum := md5.Sum(body)
+			assert.Equal(t, base64.StdEncoding.EncodeToString(sum[:]), res.Header.Get(test.header), msg)
+		case test.value == "UNIXsum=30637":
+			assert.Empty(t, res.Header.Values(test.header), msg)
+		default:
+			sha := sha256.Sum256(body)
+			sum := md5.Sum(body)
+			assert.Equal(t, "SHA-256="+base64.StdEncoding.EncodeToString(sha[:])+", md5="+base64.StdEncoding.EncodeToString(sum[:]),
+				res.Header.Get(test.header), msg)
+		}
+	}
+}
+
+func TestGzipExtra(t *testing.T) {
+	extra := []byte("LR\x04\x00logs")
+	handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testBody)
+	}), &Options{
+		Level:     DefaultCompression,
+		MinSize:   defaultMinSize,
+		GzipExtra: extra,
+	})
+
+	// The second response reuses the pooled writer.
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+
+		gr, err := gzip.NewReader(resp.Body)
+		if !assert.Nil(t, err) {
+			continue
+		}
+
+		body, err := ioutil.ReadAll(gr)
+		assert.Nil(t, err)
+		assert.Equal(t, testBody, string(body))
+		assert.Equal(t, extra, gr.Header.Extra)
+	}
+}
+
+func TestGzipOS(t *testing.T) {
+	for _, os := range []byte{0, 3, 11, 255} {
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, testBody)
+		}), &Options{
+			Level:   DefaultCompression,
+			MinSize: defaultMinSize,
+			GzipOS:  os,
+		})
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+
+		gr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			t.Fatalf("Unexpected error creating gzip reader: %v", err)
+		}
+
+		body, err := ioutil.ReadAll(gr)
+		if err != nil {
+			t.Fatalf("Unexpected error reading response body: %v", err)
+		}
+
+		expect := os
+		if expect == 0 {
+			expect = 255
+		}
+
+		assert.Equal(t, expect, gr.Header.OS)
+		assert.Equal(t, testBody, string(body))
+	}
+
+	assertPanicsWith(t, ErrInvalidGzipOS, func() {
+		GzipWithOptions(nil, &Options{Level: DefaultCompression, GzipOS: 14})
+	})
+}
+
+func TestPadding(t *testing.T) {
+	var padding int
+	handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testBody)
+	}), &Options{
+		Level:   DefaultCompression,
+		MinSize: defaultMinSize,
+		Padding: func() int {
+			return padding
+		},
+	})
+
+	unpadded := len(gzipStrLevel(testBody, DefaultCompression))
+	for _, padding = range []int{0, -1, 1, 17, 100} {
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+
+		want := unpadded
+		if padding > 0 {
+			// The comment is terminated by a zero byte.
+			want += padding + 1
+		}
+
+		assert.Equal(t, want, resp.Body.Len(), "for padding %d", padding)
+		assert.Equal(t, testBody, string(MustGunzip(resp.Body.Bytes())), "for padding %d", padding)
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	for _, explicit := range []bool{false, true} {
+		handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if explicit {
+				w.WriteHeader(http.StatusContinue)
+			}
+
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Write(body)
+		}))
+
+		srv := httptest.NewServer(handler)
+		defer srv.Close()
+
+		// The client waits for the 100 Continue for much
+		// longer than the test should take.
+		client := &http.Client{
+			Transport: &http.Transport{
+				ExpectContinueTimeout: time.Minute,
+			},
+		}
+
+		var got100 bool
+		trace := &httptrace.ClientTrace{
+			Got100Continue: func() { got100 = true },
+		}
+
+		req, _ := http.NewRequest("POST", srv.URL, strings.NewReader(testBody))
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+		req.Header.Set("Accept-Encoding", "gzip")
+		req.Header.Set("Expect", "100-continue")
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Unexpected error making http request: %v", err)
+		}
+		defer res.Body.Close()
+
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatalf("Unexpected error reading response body: %v", err)
+		}
+
+		assert.True(t, got100, "explicit: %t", explicit)
+		assert.Equal(t, 200, res.StatusCode, "explicit: %t", explicit)
+		assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"), "explicit: %t", explicit)
+		assert.Equal(t, testBody, string(MustGunzip(body)), "explicit: %t", explicit)
+	}
+}
+
+func TestLateContentEncoding(t *testing.T) {
+	for _, mode := range []HTTP10Mode{HTTP10Stream, HTTP10Buffer} {
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, testBody)
+			w.Header().Set("Content-Encoding", "br")
+			io.WriteString(w, testBody)
+		}), &Options{
+			Level:      DefaultCompression,
+			MinSize:    defaultMinSize,
+			HTTP10Mode: mode,
+		})
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Proto, req.ProtoMinor = "HTTP/1.0", 0
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		res := resp.Result()
+
+		assert.Equal(t, []string{"gzip"}, res.Header["Content-Encoding"], "for mode %d", mode)
+		assert.Equal(t, testBody+testBody, string(MustGunzip(resp.Body.Bytes())), "for mode %d", mode)
+	}
+}
+
+// encryptingResponseWriter simulates an outer middleware
+// that applies a further content coding to the response.
+type encryptingResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w encryptingResponseWriter) WriteHeader(code int) {
+	w.Header().Add("Content-Encoding", "aes128gcm")
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func TestContentEncodingOrder(t *testing.T) {
+	for _, test := range []struct {
+		contentEncoding string
+		expect          []string
+	}{
+		{"", []string{"gzip", "aes128gcm"}},
+		{"identity", []string{"gzip", "aes128gcm"}},
+		{"br", []string{"br", "aes128gcm"}},
+	} {
+		inner := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if test.contentEncoding != "" {
+				w.Header().Set("Content-Encoding", test.contentEncoding)
+			}
+			io.WriteString(w, testBody)
+		}))
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			inner.ServeHTTP(encryptingResponseWriter{w}, r)
+		})
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		res := resp.Result()
+
+		assert.Equal(t, test.expect, res.Header["Content-Encoding"], "for Content-Encoding %q", test.contentEncoding)
+	}
+}
+
+func TestAddContentEncoding(t *testing.T) {
+	for _, test := range []struct {
+		contentEncoding []string
+		expect          []string
+	}{
+		{nil, []string{"gzip"}},
+		{[]string{"identity"}, []string{"gzip"}},
+		{[]string{"Identity"}, []string{"gzip"}},
+		{[]string{"aes128gcm"}, []string{"aes128gcm", "gzip"}},
+		{[]string{"aes128gcm, identity"}, []string{"aes128gcm", "gzip"}},
+		{[]string{"gzip, aes128gcm"}, []string{"aes128gcm", "gzip"}},
+	} {
+		hdr := make(http.Header)
+		if test.contentEncoding != nil {
+			hdr["Content-Encoding"] = test.contentEncoding
+		}
+
+		addContentEncoding(hdr, "gzip")
+		assert.Equal(t, test.expect, hdr["Content-Encoding"], "for Content-Encoding %q", test.contentEncoding)
+	}
+}
+
+func TestIsEncoded(t *testing.T) {
+	for _, test := range []struct {
+		contentEncoding []string
+		encoded         bool
+	}{
+		{nil, false},
+		{[]string{""}, false},
+		{[]string{"identity"}, false},
+		{[]string{"Identity, identity"}, false},
+		{[]string{"gzip"}, true},
+		{[]string{"identity, gzip"}, true},
+		{[]string{"identity", "gzip"}, true},
+	} {
+		hdr := make(http.Header)
+		if test.contentEncoding != nil {
+			hdr["Content-Encoding"] = test.contentEncoding
+		}
+
+		assert.Equal(t, test.encoded, isEncoded(hdr), "for Content-Encoding %q", test.contentEncoding)
+	}
+}
+
+func TestAlreadyGzipped(t *testing.T) {
+	body := gzipStrLevel(testBody, gzip.DefaultCompression)
+
+	for _, contentEncoding := range [][]string{
+		{"gzip"},
+		{"GZIP"},
+		{"identity, gzip"},
+		{"identity", "gzip"},
+	} {
+		for _, minSize := range []int{0, defaultMinSize} {
+			handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header()["Content-Encoding"] = contentEncoding
+				w.Write(body)
+			}), &Options{
+				Level:   DefaultCompression,
+				MinSize: minSize,
+			})
+
+			req, _ := http.NewRequest("GET", "/whatever", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			resp := httptest.NewRecorder()
+			handler.ServeHTTP(resp, req)
+			res := resp.Result()
+
+			assert.Equal(t, contentEncoding, res.Header["Content-Encoding"],
+				"for Content-Encoding %q and MinSize %d", contentEncoding, minSize)
+			assert.Equal(t, body, resp.Body.Bytes(),
+				"for Content-Encoding %q and MinSize %d", contentEncoding, minSize)
+		}
+	}
+}
+
+func TestSkipLocalhost(t *testing.T) {
+	for _, test := range []struct {
+		remoteAddr      string
+		contentEncoding string
+	}{
+		{"127.0.0.1:1234", ""},
+		{"[::1]:1234", ""},
+		{"192.0.2.1:1234", "gzip"},
+		{"[2001:db8::1]:1234", "gzip"},
+		{"invalid", "gzip"},
+	} {
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, testBody)
+		}), &Options{
+			Level:         DefaultCompression,
+			MinSize:       defaultMinSize,
+			SkipLocalhost: true,
+		})
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.RemoteAddr = test.remoteAddr
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		res := resp.Result()
+
+		assert.Equal(t, test.contentEncoding, res.Header.Get("Content-Encoding"), "for RemoteAddr %s", test.remoteAddr)
+		assert.Equal(t, "Accept-Encoding", res.Header.Get("Vary"), "for RemoteAddr %s", test.remoteAddr)
+	}
+}
+
+func TestSkipAttachments(t *testing.T) {
+	for _, test := range []struct {
+		disposition     string
+		skipAttachments bool
+		contentEncoding string
+	}{
+		{`attachment; filename="report.csv"`, true, ""},
+		{"Attachment", true, ""},
+		{" attachment ;filename=report.csv", true, ""},
+		{`inline; filename="report.csv"`, true, "gzip"},
+		{"", true, "gzip"},
+		{`attachment; filename="report.csv"`, false, "gzip"},
+	} {
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if test.disposition != "" {
+				w.Header().Set("Content-Disposition", test.disposition)
+			}
+			io.WriteString(w, testBody)
+		}), &Options{
+			Level:           DefaultCompression,
+			MinSize:         defaultMinSize,
+			SkipAttachments: test.skipAttachments,
+		})
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		res := resp.Result()
+
+		assert.Equal(t, test.contentEncoding, res.Header.Get("Content-Encoding"),
+			"for Content-Disposition %q and SkipAttachments %t", test.disposition, test.skipAttachments)
+	}
+}
+
+func TestSkipScriptTypes(t *testing.T) {
+	for _, test := range []struct {
+		contentType     string
+		skipScriptTypes bool
+		contentEncoding string
+	}{
+		{"application/javascript", true, ""},
+		{"text/javascript; charset=utf-8", true, ""},
+		{"Application/X-JavaScript", true, ""},
+		{"application/json", true, "gzip"},
+		{"text/html", true, "gzip"},
+		{"application/javascript", false, "gzip"},
+		{"text/javascript", false, "gzip"},
+	} {
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", test.contentType)
+			io.WriteString(w, testBody)
+		}), &Options{
+			Level:           DefaultCompression,
+			MinSize:         defaultMinSize,
+			SkipScriptTypes: test.skipScriptTypes,
+		})
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		res := resp.Result()
+
+		assert.Equal(t, test.contentEncoding, res.Header.Get("Content-Encoding"),
+			"for Content-Type %q and SkipScriptTypes %t", test.contentType, test.skipScriptTypes)
+	}
+}
+
+func TestDebugDisable(t *testing.T) {
+	handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testBody)
+	}), &Options{
+		Level:              DefaultCompression,
+		MinSize:            defaultMinSize,
+		DebugDisableParam:  "nocompress",
+		DebugDisableCookie: "nocompress",
+	})
+
+	for _, test := range []struct {
+		url             string
+		cookie          string
+		contentEncoding string
+	}{
+		{"/whatever", "", "gzip"},
+		{"/whatever?nocompress=1", "", ""},
+		{"/whatever?a=b&nocompress", "", ""},
+		{"/whatever?compress=1", "", "gzip"},
+		{"/whatever", "nocompress=1", ""},
+		{"/whatever", "other=1", "gzip"},
+	} {
+		req, _ := http.NewRequest("GET", test.url, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		if test.cookie != "" {
+			req.Header.Set("Cookie", test.cookie)
+		}
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		res := resp.Result()
+
+		assert.Equal(t, test.contentEncoding, res.Header.Get("Content-Encoding"), "for URL %s and Cookie %q", test.url, test.cookie)
+		assert.Equal(t, "Accept-Encoding", res.Header.Get("Vary"), "for URL %s and Cookie %q", test.url, test.cookie)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	for _, test := range []struct {
+		method string
+		header http.Header
+	}{
+		{"GET", http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}}},
+		{"GET", http.Header{"Connection": {"keep-alive, upgrade"}}},
+		{"GET", http.Header{"Upgrade": {"websocket"}}},
+		{"CONNECT", http.Header{}},
+	} {
+		resp := httptest.NewRecorder()
+		handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.True(t, w == http.ResponseWriter(resp), "handler should be passed the underlying http.ResponseWriter")
+			io.WriteString(w, testBody)
+		}))
+
+		req, _ := http.NewRequest(test.method, "/whatever", nil)
+		req.Header = test.header
+		req.Header.Set("Accept-Encoding", "gzip")
+		handler.ServeHTTP(resp, req)
+		res := resp.Result()
+
+		assert.Empty(t, res.Header.Get("Content-Encoding"), "for %s with %v", test.method, test.header)
+		assert.Equal(t, testBody, resp.Body.String(), "for %s with %v", test.method, test.header)
+	}
+
+	assert.False(t, isUpgrade(&http.Request{
+		Method: "GET",
+		Header: http.Header{"Connection": {"keep-alive", "close"}},
+	}))
+}
+
+func TestDebugHeader(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		method         string
+		acceptEncoding string
+		http10Mode     HTTP10Mode
+		handler        http.HandlerFunc
+		expect         string
+	}{
+		{"compressed", "GET", "gzip", HTTP10Stream, func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, testBody)
+		}, "gzip"},
+		{"buffered", "GET", "gzip", HTTP10Buffer, func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, testBody)
+		}, "gzip"},
+		{"small", "GET", "gzip", HTTP10Stream, func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "test")
+		}, "identity"},
+		{"flushed", "GET", "gzip", HTTP10Stream, func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "test")
+			w.(http.Flusher).Flush()
+			io.WriteString(w, testBody)
+		}, "identity"},
+		{"incompressible", "GET", "gzip", HTTP10Stream, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "br")
+			io.WriteString(w, testBody)
+		}, "identity"},
+		{"head", "HEAD", "gzip", HTTP10Stream, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", strconv.Itoa(len(testBody)))
+		}, "gzip"},
+		{"not accepted", "GET", "identity", HTTP10Stream, func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, testBody)
+		}, "passthrough"},
+	} {
+		handler := GzipWithOptions(test.handler, &Options{
+			Level:       DefaultCompression,
+			MinSize:     defaultMinSize,
+			HTTP10Mode:  test.http10Mode,
+			DebugHeader: true,
+		})
+
+		req, _ := http.NewRequest(test.method, "/whatever", nil)
+		req.Proto, req.ProtoMinor = "HTTP/1.0", 0
+		req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		res := resp.Result()
+
+		assert.Equal(t, test.expect, res.Header.Get("X-Compression"), "for %s response", test.name)
+	}
+
+	// A response that falls back to being passed through
+	// when the writer fails isn't labelled as compressed.
+	for _, test := range []struct {
+		name      string
+		newWriter func(w io.Writer, level int) (GzipWriter, error)
+		body      string
+	}{
+		{"new writer failed", func(w io.Writer, level int) (GzipWriter, error) {
+			return nil, errors.New("new writer failed")
+		}, testBody},
+		// The writer accepted the body, so it's lost.
+		{"writer broken", func(w io.Writer, level int) (GzipWriter, error) {
+			return &failingGzipWriter{ok: 10}, nil
+		}, ""},
+	} {
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, testBody)
+		}), &Options{
+			Level:       DefaultCompression,
+			MinSize:     defaultMinSize,
+			NewWriter:   test.newWriter,
+			OnError:     func(r *http.Request, err error) {},
+			DebugHeader: true,
+		})
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := &headerSnapshotRecorder{ResponseRecorder: httptest.NewRecorder()}
+		handler.ServeHTTP(resp, req)
+
+		assert.Empty(t, resp.snapshot.Get("Content-Encoding"), "for %s", test.name)
+		assert.Equal(t, "passthrough", resp.snapshot.Get("X-Compression"), "for %s", test.name)
+		assert.Equal(t, test.body, resp.Body.String(), "for %s", test.name)
+	}
+
+	handler := newTestHandler(testBody)
+	req, _ := http.NewRequest("GET", "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	assert.NotContains(t, resp.Result().Header, "X-Compression")
+}
+
+func TestSkipOnSetCookie(t *testing.T) {
+	for _, test := range []struct {
+		setCookie       bool
+		skipOnSetCookie bool
+		contentEncoding string
+	}{
+		{true, true, ""},
+		{false, true, "gzip"},
+		{true, false, "gzip"},
+	} {
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if test.setCookie {
+				http.SetCookie(w, &http.Cookie{Name: "session", Value: "secret", HttpOnly: true})
+			}
+			io.WriteString(w, testBody)
+		}), &Options{
+			Level:           DefaultCompression,
+			MinSize:         defaultMinSize,
+			SkipOnSetCookie: test.skipOnSetCookie,
+		})
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		res := resp.Result()
+
+		assert.Equal(t, test.contentEncoding, res.Header.Get("Content-Encoding"),
+			"for Set-Cookie %t and SkipOnSetCookie %t", test.setCookie, test.skipOnSetCookie)
+		assert.Equal(t, test.setCookie, len(res.Cookies()) == 1,
+			"for Set-Cookie %t and SkipOnSetCookie %t", test.setCookie, test.skipOnSetCookie)
+	}
+}
+
+func TestWasm(t *testing.T) {
+	// The start of a WebAssembly module, with a repetitive
+	// body standing in for its code section.
+	module := append([]byte("\x00asm\x01\x00\x00\x00"), bytes.Repeat([]byte{0x20, 0x00, 0x41, 0x01, 0x6a}, 200)...)
+
+	for _, test := range []struct {
+		name            string
+		canCompress     func(http.Header) bool
+		contentEncoding string
+	}{
+		{"no predicate", nil, "gzip"},
+		{"DefaultCompressiblePredicate", DefaultCompressiblePredicate, "gzip"},
+		{"ExcludeContentTypes", ExcludeContentTypes("application/wasm"), ""},
+	} {
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/wasm")
+			w.Write(module)
+		}), &Options{
+			Level:       DefaultCompression,
+			MinSize:     defaultMinSize,
+			CanCompress: test.canCompress,
+		})
+
+		req, _ := http.NewRequest("GET", "/app.wasm", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		res := resp.Result()
+
+		assert.Equal(t, test.contentEncoding, res.Header.Get("Content-Encoding"), "for %s", test.name)
+
+		body := resp.Body.Bytes()
+		if test.contentEncoding == "gzip" {
+			body = MustGunzip(body)
+		}
+		assert.Equal(t, module, body, "for %s", test.name)
+	}
+}
+
+func TestOptIn(t *testing.T) {
+	for _, test := range []struct {
+		optIn           bool
+		value           string
+		contentEncoding string
+	}{
+		{true, "1", "gzip"},
+		{true, "", ""},
+		{true, "0", ""},
+		{false, "", "gzip"},
+		{false, "1", "gzip"},
+	} {
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if test.value != "" {
+				w.Header().Set(OptInHeader, test.value)
+			}
+			io.WriteString(w, testBody)
+		}), &Options{
+			Level:   DefaultCompression,
+			MinSize: defaultMinSize,
+			OptIn:   test.optIn,
+		})
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		res := resp.Result()
+
+		assert.Equal(t, test.contentEncoding, res.Header.Get("Content-Encoding"),
+			"for OptIn %t and %s %q", test.optIn, OptInHeader, test.value)
+		if test.optIn {
+			assert.NotContains(t, res.Header, OptInHeader,
+				"for OptIn %t and %s %q", test.optIn, OptInHeader, test.value)
+		}
+	}
+}
+
+func TestAlwaysCompressRoutes(t *testing.T) {
+	for _, test := range []struct {
+		path            string
+		contentEncoding string
+	}{
+		{"/api/users", "gzip"},
+		{"/static/users.json", "gzip"},
+		{"/", ""},
+		{"/api/users/1", ""},
+		{"/static/app.css", ""},
+	} {
+		var buffered bool
+		resp := httptest.NewRecorder()
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"ok":`)
+			buffered = resp.Body.Len() == 0
+			io.WriteString(w, `true}`)
+		}), &Options{
+			Level:                DefaultCompression,
+			MinSize:              defaultMinSize,
+			AlwaysCompressRoutes: []string{"/api/*", "/static/*.json"},
+		})
+
+		req, _ := http.NewRequest("GET", test.path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		handler.ServeHTTP(resp, req)
+
+		assert.Equal(t, test.contentEncoding, resp.Header().Get("Content-Encoding"), "for %s", test.path)
+		assert.Equal(t, test.contentEncoding == "", buffered, "for %s", test.path)
+
+		body := resp.Body.Bytes()
+		if test.contentEncoding != "" {
+			var err error
+			body, err = GunzipBytes(body)
+			assert.Nil(t, err, "for %s", test.path)
+		}
+		assert.Equal(t, `{"ok":true}`, string(body), "for %s", test.path)
+	}
+}
+
+func TestAlwaysCompressRoutesHealth(t *testing.T) {
+	const health = `{"status":"SERVING","checks":{"db":"ok","cache":"ok"}}`
+
+	for _, test := range []struct {
+		path            string
+		contentEncoding string
+	}{
+		{"/healthz", "gzip"},
+		{"/readyz", "gzip"},
+		{"/healthz/db", ""},
+		{"/", ""},
+	} {
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, health)
+		}), &Options{
+			Level:                DefaultCompression,
+			MinSize:              defaultMinSize,
+			AlwaysCompressRoutes: []string{"/healthz", "/readyz"},
+		})
+
+		req, _ := http.NewRequest("GET", test.path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+
+		assert.Equal(t, test.contentEncoding, resp.Header().Get("Content-Encoding"), "for %s", test.path)
+
+		body := resp.Body.Bytes()
+		if test.contentEncoding != "" {
+			// The framing outweighs any saving.
+			assert.True(t, len(body) > len(health), "for %s", test.path)
+			body = MustGunzip(body)
+		}
+		assert.Equal(t, health, string(body), "for %s", test.path)
+	}
+}
+
+func TestStreamBufferSize(t *testing.T) {
+	// Random data doesn't compress, so the compressed
+	// response is larger than the buffer many times over.
+	body := make([]byte, 256<<10)
+	rand.New(rand.NewSource(1)).Read(body)
+
+	var flushed int
+	resp := &writeSizeRecorder{ResponseRecorder: httptest.NewRecorder()}
+	handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body[:1000])
+		w.(http.Flusher).Flush()
+		flushed = resp.Body.Len()
+
+		for data := body[1000:]; len(data) != 0; {
+			n := min(len(data), 10000)
+			w.Write(data[:n])
+			data = data[n:]
+		}
+	}), &Options{
+		Level:            DefaultCompression,
+		MinSize:          defaultMinSize,
+		StreamBufferSize: 4096,
+	})
+
+	req, _ := http.NewRequest("GET", "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	handler.ServeHTTP(resp, req)
+
+	assert.Equal(t, "gzip", resp.Header().Get("Content-Encoding"))
+	assert.Equal(t, body, MustGunzip(resp.Body.Bytes()))
+	assert.True(t, flushed > 1000, "Flush should write out the buffer")
+	assert.True(t, len(resp.sizes) > 1)
+	for _, size := range resp.sizes {
+		assert.True(t, size <= 4096, "write of %d bytes exceeds the stream buffer", size)
+	}
+}
+
+func TestWriteContextCanceled(t *testing.T) {
+	for _, minSize := range []int{0, defaultMinSize} {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		var writeErr, readFromErr error
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, err := io.WriteString(w, testBody)
+			assert.NoError(t, err)
+			w.(http.Flusher).Flush()
+
+			cancel()
+			_, writeErr = io.WriteString(w, testBody)
+			_, readFromErr = w.(io.ReaderFrom).ReadFrom(strings.NewReader(testBody))
+		}), &Options{
+			Level:   DefaultCompression,
+			MinSize: minSize,
+		})
+
+		req, _ := http.NewRequestWithContext(ctx, "GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+
+		assert.Equal(t, context.Canceled, writeErr, "for MinSize %d", minSize)
+		assert.Equal(t, context.Canceled, readFromErr, "for MinSize %d", minSize)
+		assert.Equal(t, testBody, string(MustGunzip(resp.Body.Bytes())), "for MinSize %d", minSize)
+	}
+}
+
+func TestWriteAfterClose(t *testing.T) {
+	for _, body := range []string{smallTestBody[:100], testBody} {
+		start := make(chan struct{})
+		errs := make(chan error, 2)
+		handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, body)
+
+			// A buggy handler that keeps writing after it
+			// returns.
+			go func() {
+				<-start
+				_, err := io.WriteString(w, testBody)
+				errs <- err
+				_, err = w.(io.ReaderFrom).ReadFrom(strings.NewReader(testBody))
+				errs <- err
+			}()
+		}))
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		n := resp.Body.Len()
+
+		close(start)
+		assert.Equal(t, ErrWriteAfterClose, <-errs)
+		assert.Equal(t, ErrWriteAfterClose, <-errs)
+		assert.Equal(t, n, resp.Body.Len())
+	}
+}
+
+func TestLargeBufferNotPooled(t *testing.T) {
+	body := strings.Repeat(testBody, (512<<10)/len(testBody))
+	h := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}), &Options{
+		Level:   DefaultCompression,
+		MinSize: 1 << 20,
+	})
+
+	req, _ := http.NewRequest("GET", "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+
+	assert.Empty(t, resp.Header().Get("Content-Encoding"))
+	assert.Equal(t, body, resp.Body.String())
+
+	buf := h.(*handler).bufferPool.Get().(*[]byte)
+	assert.True(t, cap(*buf) <= maxPooledBufferSize, "pooled buffer of %d bytes was retained", cap(*buf))
+}
+
+func TestCompressedCacheHandler(t *testing.T) {
+	var runs int
+	var stats []Stats
+	handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		runs++
+		w.Header().Set("ETag", r.URL.Query().Get("etag"))
+		if cc := r.URL.Query().Get("cc"); cc != "" {
+			w.Header().Set("Cache-Control", cc)
+		}
+		io.WriteString(w, testBody)
+	}), &Options{
+		Level:           DefaultCompression,
+		MinSize:         defaultMinSize,
+		CompressedCache: NewCompressedCache(1 << 20),
+		Stats: func(r *http.Request, s Stats) {
+			stats = append(stats, s)
+		},
+	})
+
+	for _, test := range []struct {
+		etag         string
+		cacheControl string
+		cached       bool
+	}{
+		{`"v1"`, "", false},
+		{`"v1"`, "", true},
+		{`"v2"`, "", false},
+		{`"v1"`, "", true},
+		{`W/"v3"`, "", false},
+		{`W/"v3"`, "", false},
+		{"", "", false},
+		{`"v4"`, "no-store", false},
+		{`"v4"`, "no-store", false},
+		{`"v5"`, `private="Set-Cookie", max-age=60`, false},
+		{`"v5"`, `private="Set-Cookie", max-age=60`, false},
+		{`"v7"`, "No-Store", false},
+		{`"v7"`, "No-Store", false},
+		{`"v6"`, "public, max-age=60", false},
+		{`"v6"`, "public, max-age=60", true},
+	} {
+		stats = nil
+		req, _ := http.NewRequest("GET", "/whatever?etag="+url.QueryEscape(test.etag)+"&cc="+url.QueryEscape(test.cacheControl), nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+
+		assert.Equal(t, "gzip", resp.Header().Get("Content-Encoding"), "for ETag %s", test.etag)
+		body, err := GunzipBytes(resp.Body.Bytes())
+		assert.Nil(t, err, "for ETag %s", test.etag)
+		assert.Equal(t, testBody, string(body), "for ETag %s", test.etag)
+
+		if assert.Len(t, stats, 1, "for ETag %s", test.etag) {
+			assert.True(t, stats[0].Compressed, "for ETag %s", test.etag)
+			assert.Equal(t, test.cached, stats[0].Cached, "for ETag %s", test.etag)
+		}
+
+		if test.cached {
+			assert.Equal(t, strconv.Itoa(resp.Body.Len()), resp.Header().Get("Content-Length"), "for ETag %s", test.etag)
+		}
+	}
+
+	// The handler runs for every request, even when its
+	// response is discarded.
+	assert.Equal(t, 15, runs)
+}
+
+func TestCompressedCacheShared(t *testing.T) {
+	cache := NewCompressedCache(1 << 20)
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		io.WriteString(w, testBody)
+	})
+
+	var handlers []http.Handler
+	for _, gzipOS := range []byte{3, 7} {
+		handlers = append(handlers, GzipWithOptions(inner, &Options{
+			Level:           DefaultCompression,
+			MinSize:         defaultMinSize,
+			GzipOS:          gzipOS,
+			CompressedCache: cache,
+		}))
+	}
+
+	// Each handler sends its own gzip header, rather than
+	// replaying the other's response.
+	for i := 0; i < 2; i++ {
+		for j, gzipOS := range []byte{3, 7} {
+			req, _ := http.NewRequest("GET", "/whatever", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			resp := httptest.NewRecorder()
+			handlers[j].ServeHTTP(resp, req)
+
+			gr, err := gzip.NewReader(resp.Body)
+			if assert.Nil(t, err, "for OS %d", gzipOS) {
+				assert.Equal(t, gzipOS, gr.Header.OS, "for OS %d", gzipOS)
+			}
+		}
+	}
+}
+
+func TestCompressedCacheMaxConcurrent(t *testing.T) {
+	var h *handler
+	var held []int
+	h = GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		io.WriteString(w, testBody)
+		held = append(held, len(h.sem))
+	}), &Options{
+		Level:           DefaultCompression,
+		MinSize:         defaultMinSize,
+		MaxConcurrent:   1,
+		CompressedCache: NewCompressedCache(1 << 20),
+	}).(*handler)
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+
+		assert.Equal(t, "gzip", resp.Header().Get("Content-Encoding"))
+	}
+
+	// The first response is compressed, the second is
+	// replayed from the cache without holding a slot.
+	assert.Equal(t, []int{1, 0}, held)
+}
+
+func TestFlushOnNewline(t *testing.T) {
+	lines := []string{
+		`{"id":1}` + "\n",
+		`{"id":2}` + "\n",
+		`{"id":3}` + "\n",
+	}
+
+	for _, test := range []struct {
+		contentType string
+		flushed     bool
+	}{
+		{"application/x-ndjson", true},
+		{"application/x-ndjson; charset=utf-8", true},
+		{"text/plain", false},
+	} {
+		var decoded []string
+		resp := httptest.NewRecorder()
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", test.contentType)
+
+			for _, line := range lines {
+				io.WriteString(w, line)
+
+				// Decode what the client has received so
+				// far, which ends part way through the
+				// gzip stream.
+				var got []byte
+				if resp.Body.Len() != 0 {
+					gr, err := gzip.NewReader(bytes.NewReader(resp.Body.Bytes()))
+					if assert.Nil(t, err, "for %s", test.contentType) {
+						got, err = ioutil.ReadAll(gr)
+						assert.Equal(t, io.ErrUnexpectedEOF, err, "for %s", test.contentType)
+					}
+				}
+				decoded = append(decoded, string(got))
+			}
+		}), &Options{
+			Level:          DefaultCompression,
+			MinSize:        defaultMinSize,
+			FlushOnNewline: true,
+		})
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		handler.ServeHTTP(resp, req)
+
+		if test.flushed {
+			assert.Equal(t, "gzip", resp.Header().Get("Content-Encoding"), "for %s", test.contentType)
+			assert.True(t, resp.Flushed, "for %s", test.contentType)
+			assert.Equal(t, []string{
+				lines[0],
+				lines[0] + lines[1],
+				lines[0] + lines[1] + lines[2],
+			}, decoded, "for %s", test.contentType)
+		} else {
+			// The response is buffered, and then too
+			// small to be compressed.
+			assert.Empty(t, resp.Header().Get("Content-Encoding"), "for %s", test.contentType)
+			assert.Equal(t, []string{"", "", ""}, decoded, "for %s", test.contentType)
+		}
+	}
+}
+
+func TestTimeoutHandler(t *testing.T) {
+	for _, timeout := range []bool{false, true} {
+		for _, gzipOutside := range []bool{false, true} {
+			done := make(chan struct{})
+			var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer close(done)
+
+				// http.TimeoutHandler's ResponseWriter is not
+				// an http.Flusher, so the error is ignored.
+
+				w.Header().Set("Content-Type", "text/plain")
+				io.WriteString(w, testBody[:100])
+				http.NewResponseController(w).Flush()
+				io.WriteString(w, testBody[100:])
+				http.NewResponseController(w).Flush()
+
+				if timeout {
+					<-r.Context().Done()
+					io.WriteString(w, testBody)
+					http.NewResponseController(w).Flush()
+				}
+			})
+
+			if gzipOutside {
+				handler = Gzip(http.TimeoutHandler(handler, 50*time.Millisecond, "timed out"))
+			} else {
+				handler = http.TimeoutHandler(Gzip(handler), 50*time.Millisecond, "timed out")
+			}
+
+			req, _ := http.NewRequest("GET", "/whatever", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			resp := httptest.NewRecorder()
+			handler.ServeHTTP(resp, req)
+			<-done
+
+			if timeout {
+				assert.Equal(t, http.StatusServiceUnavailable, resp.Code, "for timeout %t and Gzip outside %t", timeout, gzipOutside)
+				assert.Empty(t, resp.Header().Get("Content-Encoding"), "for timeout %t and Gzip outside %t", timeout, gzipOutside)
+				assert.Equal(t, "timed out", resp.Body.String(), "for timeout %t and Gzip outside %t", timeout, gzipOutside)
+				continue
+			}
+
+			// Flushing behind http.TimeoutHandler has no
+			// effect, so it doesn't prevent compression.
+			assert.Equal(t, http.StatusOK, resp.Code, "for timeout %t and Gzip outside %t", timeout, gzipOutside)
+			assert.Equal(t, "gzip", resp.Header().Get("Content-Encoding"), "for timeout %t and Gzip outside %t", timeout, gzipOutside)
+			assert.Equal(t, testBody, string(MustGunzip(resp.Body.Bytes())), "for timeout %t and Gzip outside %t", timeout, gzipOutside)
+		}
+	}
+}
+
+func TestAlwaysCompressTypes(t *testing.T) {
+	svg := `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 8 8"><circle cx="4" cy="4" r="4" fill="#000"/></svg>`
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 92)
+
+	for _, test := range []struct {
+		contentType     string
+		contentLength   bool
+		body            string
+		contentEncoding string
+	}{
+		{"image/svg+xml", false, svg, "gzip"},
+		{"image/SVG+xml; charset=utf-8", false, svg, "gzip"},
+		{"image/svg+xml", true, svg, "gzip"},
+		{"image/png", false, png, ""},
+		{"", false, png, ""},
+		{"", false, testBody[:100], "gzip"},
+		{"image/png", false, testBody, "gzip"},
+	} {
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if test.contentType != "" {
+				w.Header().Set("Content-Type", test.contentType)
+			}
+			if test.contentLength {
+				w.Header().Set("Content-Length", strconv.Itoa(len(test.body)))
+			}
+			io.WriteString(w, test.body)
+		}), &Options{
+			Level:               DefaultCompression,
+			MinSize:             defaultMinSize,
+			AlwaysCompressTypes: []string{"image/svg+xml", "text/plain"},
+		})
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+
+		assert.Equal(t, test.contentEncoding, resp.Header().Get("Content-Encoding"),
+			"for Content-Type %q and body of length %d", test.contentType, len(test.body))
+
+		body := resp.Body.Bytes()
+		if test.contentEncoding != "" {
+			body = MustGunzip(body)
+		}
+		assert.Equal(t, test.body, string(body),
+			"for Content-Type %q and body of length %d", test.contentType, len(test.body))
+	}
+}
+
+func TestAlwaysCompressTypesSniffed(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 8)
+
+	for _, test := range []struct {
+		writes          []string
+		contentType     string
+		contentEncoding string
+	}{
+		{[]string{png, "text"}, "image/png", ""},
+		{[]string{"", png, "text"}, "image/png", ""},
+		{[]string{"text", png}, "text/plain; charset=utf-8", "gzip"},
+	} {
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, b := range test.writes {
+				io.WriteString(w, b)
+			}
+		}), &Options{
+			Level:               DefaultCompression,
+			MinSize:             defaultMinSize,
+			AlwaysCompressTypes: []string{"text/plain"},
+		})
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+
+		// The type is sniffed from the start of the body,
+		// not from whichever write happens to be text.
+		assert.Equal(t, test.contentEncoding, resp.Header().Get("Content-Encoding"), "for writes %q", test.writes)
+		assert.Equal(t, test.contentType, resp.Header().Get("Content-Type"), "for writes %q", test.writes)
+
+		body := resp.Body.Bytes()
+		if test.contentEncoding != "" {
+			body = MustGunzip(body)
+		}
+		assert.Equal(t, strings.Join(test.writes, ""), string(body), "for writes %q", test.writes)
+	}
+}
+
+func TestReadFrom(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		reader func(io.Reader) io.Reader
+	}{
+		{"Reader", func(r io.Reader) io.Reader { return r }},
+		{"OneByteReader", iotest.OneByteReader},
+		{"HalfReader", iotest.HalfReader},
+		{"DataErrReader", iotest.DataErrReader},
+	} {
+		for _, body := range []string{smallTestBody[:100], testBody} {
+			handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n, err := w.(io.ReaderFrom).ReadFrom(test.reader(strings.NewReader(body)))
+				assert.Nil(t, err, "for %s", test.name)
+				assert.Equal(t, int64(len(body)), n, "for %s", test.name)
+			}))
+
+			req, _ := http.NewRequest("GET", "/whatever", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			resp := httptest.NewRecorder()
+			handler.ServeHTTP(resp, req)
+
+			got := resp.Body.Bytes()
+			if len(body) >= defaultMinSize {
+				assert.Equal(t, "gzip", resp.Header().Get("Content-Encoding"), "for %s", test.name)
+				var err error
+				got, err = GunzipBytes(got)
+				assert.Nil(t, err, "for %s", test.name)
+			} else {
+				assert.Equal(t, "", resp.Header().Get("Content-Encoding"), "for %s", test.name)
+			}
+			assert.Equal(t, body, string(got), "for %s", test.name)
+		}
+	}
+}
+
+func TestReadFromError(t *testing.T) {
+	errRead := errors.New("read failed")
+	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, err := w.(io.ReaderFrom).ReadFrom(io.MultiReader(strings.NewReader(testBody), iotest.ErrReader(errRead)))
+		assert.Equal(t, errRead, err)
+		assert.Equal(t, int64(len(testBody)), n)
+	}))
+
+	req, _ := http.NewRequest("GET", "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	assert.Equal(t, "gzip", resp.Header().Get("Content-Encoding"))
+	got, err := GunzipBytes(resp.Body.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, testBody, string(got))
+}
+
+// readerFromRecorder is an httptest.ResponseRecorder that
+// is an io.ReaderFrom, as the net/http response is.
+type readerFromRecorder struct {
+	*httptest.ResponseRecorder
+	readFrom bool
+}
+
+func (r *readerFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	r.readFrom = true
+	return io.Copy(r.ResponseRecorder, src)
+}
+
+func TestReadFromDelegates(t *testing.T) {
+	for _, test := range []struct {
+		acceptEncoding string
+		readFrom       bool
+	}{
+		{"gzip", false},
+		{"identity", true},
+	} {
+		handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Hide strings.Reader's WriteTo method, which
+			// io.Copy would otherwise prefer.
+			io.Copy(w, struct{ io.Reader }{strings.NewReader(testBody)})
+		}))
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		resp := &readerFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+		handler.ServeHTTP(resp, req)
+
+		assert.Equal(t, test.readFrom, resp.readFrom, "for Accept-Encoding %s", test.acceptEncoding)
+
+		got := resp.Body.Bytes()
+		if !test.readFrom {
+			var err error
+			got, err = GunzipBytes(got)
+			assert.Nil(t, err, "for Accept-Encoding %s", test.acceptEncoding)
+		}
+		assert.Equal(t, testBody, string(got), "for Accept-Encoding %s", test.acceptEncoding)
+	}
+}
+
+func TestNewWriter(t *testing.T) {
+	var created int
+	handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testBody)
+	}), &Options{
+		Level:   BestCompression,
+		MinSize: defaultMinSize,
+		NewWriter: func(w io.Writer, level int) (GzipWriter, error) {
+			assert.Nil(t, w)
+			assert.Equal(t, BestCompression, level)
+
+			created++
+			return gzip.NewWriterLevel(w, BestSpeed)
+		},
+	})
+
+	req, _ := http.NewRequest("GET", "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	res := resp.Result()
+
+	assert.Equal(t, 1, created)
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, gzipStrLevel(testBody, BestSpeed), resp.Body.Bytes())
+	assert.Equal(t, testBody, string(MustGunzip(resp.Body.Bytes())))
+}
+
+func TestWriterPool(t *testing.T) {
+	var created int
+	pool := &sync.Pool{
+		New: func() interface{} {
+			created++
+			gw, _ := gzip.NewWriterLevel(nil, BestSpeed)
+			return gw
+		},
+	}
+
+	opts := &Options{
+		Level:      BestSpeed,
+		MinSize:    defaultMinSize,
+		WriterPool: pool,
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testBody)
+	})
+
+	// The pool is shared between handlers.
+	handlers := []http.Handler{
+		GzipWithOptions(handler, opts),
+		GzipWithOptions(handler, opts),
+	}
+
+	for i := 0; i < 4; i++ {
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handlers[i%2].ServeHTTP(resp, req)
+
+		assert.Equal(t, "gzip", resp.Header().Get("Content-Encoding"))
+		body, err := GunzipBytes(resp.Body.Bytes())
+		assert.Nil(t, err)
+		assert.Equal(t, testBody, string(body))
+	}
+
+	// sync.Pool may drop writers, so more than one may
+	// have been created.
+	assert.True(t, created >= 1, "expected the pool's New function to be used")
+
+	// The writers are returned to the pool.
+	_, ok := pool.Get().(*gzip.Writer)
+	assert.True(t, ok, "expected a *gzip.Writer in the pool")
+}
+
+func TestWriterPoolInvalid(t *testing.T) {
+	var errs []error
+	handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testBody)
+	}), &Options{
+		Level:   DefaultCompression,
+		MinSize: defaultMinSize,
+		WriterPool: &sync.Pool{
+			New: func() interface{} { return new(bytes.Buffer) },
+		},
+		OnError: func(r *http.Request, err error) {
+			errs = append(errs, err)
+		},
+	})
+
+	req, _ := http.NewRequest("GET", "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	assert.Empty(t, resp.Header().Get("Content-Encoding"))
+	assert.Equal(t, testBody, resp.Body.String())
+	assert.Equal(t, []error{ErrInvalidPooledWriter}, errs)
+}
+
+func TestGzipWriteError(t *testing.T) {
+	errWrite := errors.New("write failed")
+
+	for _, noBuffer := range []bool{false, true} {
+		var errs []error
+		var writeErr error
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, s := range []string{testBody[:100], testBody, testBody} {
+				if _, writeErr = io.WriteString(w, s); writeErr != nil {
+					return
+				}
+			}
+		}), &Options{
+			Level:    DefaultCompression,
+			MinSize:  defaultMinSize,
+			NoBuffer: noBuffer,
+			NewWriter: func(w io.Writer, level int) (GzipWriter, error) {
+				// The writer accepts the first write,
+				// without writing anything, and fails on
+				// the next.
+				return &failingGzipWriter{err: errWrite, ok: 1}, nil
+			},
+			OnError: func(r *http.Request, err error) {
+				errs = append(errs, err)
+			},
+		})
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := &headerSnapshotRecorder{ResponseRecorder: httptest.NewRecorder()}
+		handler.ServeHTTP(resp, req)
+
+		// Nothing was sent before the writer failed. If
+		// the writes it accepted were buffered, the
+		// response is passed through uncompressed.
+		// Otherwise, they are lost and the error is
+		// returned.
+		assert.Empty(t, resp.snapshot.Get("Content-Encoding"), "for NoBuffer %t", noBuffer)
+		assert.Equal(t, []error{errWrite}, errs, "for NoBuffer %t", noBuffer)
+		if noBuffer {
+			assert.Equal(t, errWrite, writeErr)
+			assert.Empty(t, resp.Body.String())
+		} else {
+			assert.Nil(t, writeErr)
+			assert.Equal(t, testBody[:100]+testBody+testBody, resp.Body.String())
+		}
+	}
+}
+
+func TestGzipUnderlyingWriteError(t *testing.T) {
+	errWrite := errors.New("write failed")
+
+	var errs, writeErrs []error
+	handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testBody[:100])
+		_, err := io.WriteString(w, testBody)
+		writeErrs = append(writeErrs, err)
+	}), &Options{
+		Level:   DefaultCompression,
+		MinSize: defaultMinSize,
+		OnError: func(r *http.Request, err error) {
+			errs = append(errs, err)
+		},
+	})
+
+	req, _ := http.NewRequest("GET", "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := &writeErrorRecorder{httptest.NewRecorder(), errWrite}
+	handler.ServeHTTP(resp, req)
+
+	// The headers were committed along with the failed
+	// write, so the error is surfaced rather than the
+	// response being passed through. Closing the
+	// response fails too.
+	assert.Equal(t, "gzip", resp.Header().Get("Content-Encoding"))
+	if assert.Len(t, errs, 2) {
+		assert.Equal(t, errWrite, errs[0])
+		assert.True(t, errors.Is(errs[1], errWrite))
+	}
+	assert.Equal(t, []error{errWrite}, writeErrs)
+}
+
+func TestNewWriterError(t *testing.T) {
+	errNewWriter := errors.New("new writer failed")
+
+	for _, opts := range []Options{
+		{},
+		{SampleRatio: 0.9},
+		{HTTP10Mode: HTTP10Buffer},
+		{MaxConcurrent: 1},
+	} {
+		var errs []error
+		opts.Level = DefaultCompression
+		opts.MinSize = defaultMinSize
+		opts.NewWriter = func(w io.Writer, level int) (GzipWriter, error) {
+			return nil, errNewWriter
+		}
+		opts.OnError = func(r *http.Request, err error) {
+			errs = append(errs, err)
+		}
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, testBody)
+			io.WriteString(w, testBody)
+		}), &opts)
+
+		for i := 0; i < 2; i++ {
+			req, _ := http.NewRequest("GET", "/whatever", nil)
+			req.Proto, req.ProtoMinor = "HTTP/1.0", 0
+			req.Header.Set("Accept-Encoding", "gzip")
+			resp := httptest.NewRecorder()
+			handler.ServeHTTP(resp, req)
+			res := resp.Result()
+
+			assert.Empty(t, res.Header.Get("Content-Encoding"), "for %+v", opts)
+			assert.Equal(t, testBody+testBody, resp.Body.String(), "for %+v", opts)
+		}
+
+		// Each response reports the error once and, with
+		// MaxConcurrent, doesn't hold on to its slot.
+		assert.Equal(t, []error{errNewWriter, errNewWriter}, errs, "for %+v", opts)
+	}
+}
+
+func TestHeadContentLength(t *testing.T) {
+	for _, body := range []string{testBody, "test"} {
+		handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			if r.Method != http.MethodHead {
+				io.WriteString(w, body)
+			}
+		}))
+
+		header := make(map[string]http.Header)
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			req, _ := http.NewRequest(method, "/whatever", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			resp := httptest.NewRecorder()
+			handler.ServeHTTP(resp, req)
+
+			header[method] = resp.Result().Header
+		}
+
+		assert.Equal(t, header[http.MethodGet], header[http.MethodHead], "for body of length %d", len(body))
+	}
+}
+
+func TestTrailers(t *testing.T) {
+	for _, body := range []string{testBody, "test"} {
+		handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Trailer", "X-Declared")
+			if len(body) >= defaultMinSize {
+				// Trailers can't be sent with a short uncompressed
+				// response with a Content-Length, but the header
+				// is removed from compressed responses.
+				w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			}
+			io.WriteString(w, body)
+
+			w.Header().Set("X-Declared", "declared")
+			w.Header().Set(http.TrailerPrefix+"X-Deferred", "deferred")
+		}))
+
+		srv := httptest.NewServer(handler)
+		defer srv.Close()
+
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Unexpected error making http request: %v", err)
+		}
+		defer res.Body.Close()
+
+		b, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatalf("Unexpected error reading response body: %v", err)
+		}
+
+		if res.Header.Get("Content-Encoding") == "gzip" {
+			b = MustGunzip(b)
+		}
+
+		assert.Equal(t, body, string(b))
+		assert.Equal(t, "declared", res.Trailer.Get("X-Declared"), "for body of length %d", len(body))
+		assert.Equal(t, "deferred", res.Trailer.Get("X-Deferred"), "for body of length %d", len(body))
+	}
+}
+
+func TestServeFileFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"file.txt": &fstest.MapFile{
+			Data:    []byte(testBody),
+			ModTime: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}
+
+	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeFileFS(w, r, fsys, "file.txt")
+	}))
+
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	for _, test := range []struct {
+		header          http.Header
+		statusCode      int
+		contentEncoding string
+		body            string
+	}{
+		{http.Header{}, http.StatusOK, "gzip", testBody},
+		{http.Header{"If-None-Match": {`"v1"`}}, http.StatusNotModified, "", ""},
+		{http.Header{"If-None-Match": {`"v0"`}}, http.StatusOK, "gzip", testBody},
+		{http.Header{"If-Modified-Since": {"Tue, 02 Jan 2024 00:00:00 GMT"}}, http.StatusNotModified, "", ""},
+		{http.Header{"Range": {"bytes=0-9"}}, http.StatusPartialContent, "", testBody[:10]},
+		{http.Header{"Range": {"bytes=10-"}}, http.StatusPartialContent, "", testBody[10:]},
+	} {
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		req.Header = test.header
+		req.Header.Set("Accept-Encoding", "gzip")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Unexpected error making http request: %v", err)
+		}
+
+		b, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("Unexpected error reading response body: %v", err)
+		}
+
+		if res.Header.Get("Content-Encoding") == "gzip" {
+			// The Content-Length of the file must not be sent
+			// with the compressed body.
+			if res.ContentLength != -1 {
+				assert.Equal(t, int64(len(b)), res.ContentLength, "for %v", test.header)
+			}
+			assert.Empty(t, res.Header.Get("Accept-Ranges"), "for %v", test.header)
+
+			b = MustGunzip(b)
+		}
+
+		assert.Equal(t, test.statusCode, res.StatusCode, "for %v", test.header)
+		assert.Equal(t, test.contentEncoding, res.Header.Get("Content-Encoding"), "for %v", test.header)
+		assert.Equal(t, test.body, string(b), "for %v", test.header)
+		assert.Equal(t, "Accept-Encoding", res.Header.Get("Vary"), "for %v", test.header)
+	}
+}
+
+func TestGzipHandlerMinSize(t *testing.T) {
+	handler := GzipWithLevelAndMinSize(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			resp, _ := ioutil.ReadAll(r.Body)
+			w.Write(resp)
+			// Call write multiple times to pass through "chosenWriter"
+			w.Write(resp)
+			w.Write(resp)
+		},
+	), gzip.DefaultCompression, 13)
+
+	// Run a test with size smaller than the limit
+	b := bytes.NewBufferString("test")
+
+	req1, _ := http.NewRequest("GET", "/whatever", b)
+	req1.Header.Add("Accept-Encoding", "gzip")
+	resp1 := httptest.NewRecorder()
+	handler.ServeHTTP(resp1, req1)
+	res1 := resp1.Result()
+
+	if res1.Header.Get("Content-Encoding") == "gzip" {
+		t.Errorf("The response is compress and should not")
+		return
+	}
+
+	// Run a test with size bigger than the limit
+	b = bytes.NewBufferString(smallTestBody)
+
+	req2, _ := http.NewRequest("GET", "/whatever", b)
+	req2.Header.Add("Accept-Encoding", "gzip")
+	resp2 := httptest.NewRecorder()
+	handler.ServeHTTP(resp2, req2)
+	res2 := resp2.Result()
+
+	if res2.Header.Get("Content-Encoding") != "gzip" {
+		t.Errorf("The response is not compress and should")
+		return
+	}
+
+	assert.Panics(t, func() {
+		GzipWithLevelAndMinSize(nil, gzip.DefaultCompression, -10)
+	}, "GzipWithLevelAndMinSize did not panic on negative minSize")
+}
+
+func TestMinSizeFunc(t *testing.T) {
+	var errs []error
+	handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, smallTestBody)
+	}), &Options{
+		Level:   DefaultCompression,
+		MinSize: 100,
+		OnError: func(r *http.Request, err error) {
+			errs = append(errs, err)
+		},
+		MinSizeFunc: func(r *http.Request) int {
+			switch r.URL.Path {
+			case "/export":
+				return 0
+			case "/invalid":
+				return -1
+			default:
+				return 1024
+			}
+		},
+	})
+
+	for _, test := range []struct {
+		path            string
+		contentEncoding string
+	}{
+		{"/export", "gzip"},
+		{"/api", ""},
+		// A negative minimum size falls back to MinSize.
+		{"/invalid", "gzip"},
+	} {
+		req, _ := http.NewRequest("GET", test.path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		res := resp.Result()
+
+		assert.Equal(t, test.contentEncoding, res.Header.Get("Content-Encoding"), "for path %s", test.path)
+	}
+
+	assert.Equal(t, []error{ErrNegativeMinSize}, errs)
+}
+
+func TestGzipDoubleClose(t *testing.T) {
+	h := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// call close here and it'll get called again interally by
+		// NewGzipLevelHandler's handler defer
+		w.Write([]byte("test"))
+		w.(io.Closer).Close()
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	// the second close shouldn't have added the same writer
+	// so we pull out 2 writers from the pool and make sure they're different
+	w1, _ := h.(*handler).pool.Get()
+	w2, _ := h.(*handler).pool.Get()
+	// assert.NotEqual looks at the value and not the address, so we use regular ==
+	assert.False(t, w1 == w2)
+}
+
+func TestBufferPoolPerHandler(t *testing.T) {
+	h1 := Gzip(http.NotFoundHandler()).(*handler)
+	h2 := Gzip(http.NotFoundHandler()).(*handler)
+
+	assert.False(t, h1.bufferPool == h2.bufferPool)
+
+	buf := make([]byte, 0, 1)
+	h1.bufferPool.Put(&buf)
+
+	// assert.NotEqual looks at the value and not the address, so we use regular ==
+	assert.False(t, h2.bufferPool.Get().(*[]byte) == &buf)
+}
+
+func TestSynchronized(t *testing.T) {
+	const chunkSize, chunks = 64, 100
+
+	handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var wg sync.WaitGroup
+		for _, c := range []byte("ab") {
+			wg.Add(1)
+			go func(chunk []byte) {
+				defer wg.Done()
+
+				for i := 0; i < chunks; i++ {
+					w.Write(chunk)
+				}
+			}(bytes.Repeat([]byte{c}, chunkSize))
+		}
+		wg.Wait()
+	}), &Options{
+		Level:        DefaultCompression,
+		MinSize:      defaultMinSize,
+		Synchronized: true,
+	})
+
+	req, _ := http.NewRequest("GET", "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	gr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatalf("Unexpected error creating gzip reader: %v", err)
+	}
+
+	body, err := ioutil.ReadAll(gr)
+	if err != nil {
+		t.Fatalf("Unexpected error reading response body: %v", err)
+	}
+
+	if !assert.Len(t, body, 2*chunkSize*chunks) {
+		return
+	}
+
+	for i := 0; i < len(body); i += chunkSize {
+		chunk := body[i : i+chunkSize]
+		assert.Equal(t, bytes.Repeat(chunk[:1], chunkSize), chunk, "chunk at offset %d was corrupted", i)
+	}
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	const n = 4
+
+	// Every handler writes its response before any of
+	// them returns, so only one response can be
+	// compressed at once.
+	var written sync.WaitGroup
+	written.Add(n)
+	handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testBody)
+		written.Done()
+		written.Wait()
+	}), &Options{
+		Level:         DefaultCompression,
+		MinSize:       defaultMinSize,
+		MaxConcurrent: 1,
+	})
+
+	var wg sync.WaitGroup
+	resps := make([]*httptest.ResponseRecorder, n)
+	for i := range resps {
+		resps[i] = httptest.NewRecorder()
+
+		wg.Add(1)
+		go func(resp *httptest.ResponseRecorder) {
+			defer wg.Done()
+
+			req, _ := http.NewRequest("GET", "/whatever", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			handler.ServeHTTP(resp, req)
+		}(resps[i])
+	}
+	wg.Wait()
+
+	var compressed int
+	for _, resp := range resps {
+		body := resp.Body.Bytes()
+		if resp.Header().Get("Content-Encoding") == "gzip" {
+			compressed++
+			body = MustGunzip(body)
+		}
+
+		assert.Equal(t, testBody, string(body))
+	}
+	assert.Equal(t, 1, compressed, "responses compressed at once")
+
+	// The slot is released once the response is closed.
+	req, _ := http.NewRequest("GET", "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+	written.Add(1)
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, "gzip", resp.Header().Get("Content-Encoding"))
+}
+
+func TestBufferForContentLength(t *testing.T) {
+	// Random data doesn't compress, so the compressed
+	// response is too large for the server to set its
+	// Content-Length itself.
+	body := make([]byte, 16<<10)
+	rand.New(rand.NewSource(1)).Read(body)
+
+	for _, test := range []struct {
+		declared bool
+		limit    int
+		chunked  bool
+	}{
+		{true, 32 << 10, false},
+		{true, len(body), false},
+		{true, 8 << 10, true},
+		{false, 32 << 10, true},
+	} {
+		srv := httptest.NewServer(GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			if test.declared {
+				w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			}
+			for data := body; len(data) != 0; data = data[1024:] {
+				w.Write(data[:1024])
+			}
+		}), &Options{
+			Level:                  DefaultCompression,
+			MinSize:                defaultMinSize,
+			BufferForContentLength: test.limit,
+		}))
+
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+		res, err := client.Do(req)
+		if !assert.NoError(t, err) {
+			srv.Close()
+			continue
+		}
+
+		compressed, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		srv.Close()
+		assert.NoError(t, err)
+
+		assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"),
+			"for declared length %t and BufferForContentLength %d", test.declared, test.limit)
+		assert.Equal(t, body, MustGunzip(compressed),
+			"for declared length %t and BufferForContentLength %d", test.declared, test.limit)
+		if test.chunked {
+			assert.Equal(t, []string{"chunked"}, res.TransferEncoding,
+				"for declared length %t and BufferForContentLength %d", test.declared, test.limit)
+			assert.Equal(t, int64(-1), res.ContentLength,
+				"for declared length %t and BufferForContentLength %d", test.declared, test.limit)
+		} else {
+			assert.Empty(t, res.TransferEncoding,
+				"for declared length %t and BufferForContentLength %d", test.declared, test.limit)
+			assert.Equal(t, int64(len(compressed)), res.ContentLength,
+				"for declared length %t and BufferForContentLength %d", test.declared, test.limit)
+		}
+	}
+}
+
+func TestUncompressedLengthTrailer(t *testing.T) {
+	body := strings.Repeat(testBody, 4)
+	srv := httptest.NewServer(GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 4; i++ {
+			io.WriteString(w, testBody)
+			w.(http.Flusher).Flush()
+		}
+	}), &Options{
+		Level:                     DefaultCompression,
+		MinSize:                   defaultMinSize,
+		UncompressedLengthTrailer: true,
+	}))
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	res, err := client.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	_, declared := res.Trailer["X-Uncompressed-Content-Length"]
+	assert.True(t, declared, "the trailer should be declared")
+
+	compressed, err := ioutil.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, body, string(MustGunzip(compressed)))
+
+	// The trailer is only available once the body has
+	// been read.
+	assert.Equal(t, strconv.Itoa(len(body)), res.Trailer.Get("X-Uncompressed-Content-Length"))
+}
+
+func TestUncompressedLengthTrailerHeader(t *testing.T) {
+	for _, test := range []struct {
+		protoMinor int
+		declared   bool
+		emit       bool
+		trailer    bool
+	}{
+		{0, false, true, true},
+		{1, true, true, true},
+		{0, false, true, false},
+		{0, false, false, true},
+	} {
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if test.declared {
+				w.Header().Set("Content-Length", strconv.Itoa(len(testBody)))
+			}
+			io.WriteString(w, testBody)
+		}), &Options{
+			Level:                     DefaultCompression,
+			MinSize:                   defaultMinSize,
+			HTTP10Mode:                HTTP10Buffer,
+			EmitUncompressedLength:    test.emit,
+			UncompressedLengthTrailer: test.trailer,
+		})
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.ProtoMinor = test.protoMinor
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := &headerSnapshotRecorder{ResponseRecorder: httptest.NewRecorder()}
+		handler.ServeHTTP(resp, req)
+
+		// The length is known before the header is
+		// written, so no trailer is needed.
+		assert.Equal(t, "gzip", resp.snapshot.Get("Content-Encoding"), "for %+v", test)
+		assert.Equal(t, strconv.Itoa(len(testBody)), resp.snapshot.Get("X-Uncompressed-Content-Length"), "for %+v", test)
+		_, trailer := resp.snapshot["Trailer"]
+		assert.False(t, trailer, "for %+v", test)
+	}
+}
+
+func TestIfRange(t *testing.T) {
+	content := strings.Repeat(testBody, 4)
+	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "test.txt", time.Time{}, strings.NewReader(content))
+	}))
+
+	for _, test := range []struct {
+		rangeHeader, ifRange string
+		code                 int
+		contentEncoding      string
+		body                 string
+	}{
+		{"bytes=0-99", `"v1"`, http.StatusPartialContent, "", content[:100]},
+		{"bytes=0-99", `"v0"`, http.StatusOK, "", content},
+		{"bytes=0-99", "", http.StatusPartialContent, "", content[:100]},
+		{"", "", http.StatusOK, "gzip", content},
+	} {
+		req, _ := http.NewRequest("GET", "/test.txt", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		if test.rangeHeader != "" {
+			req.Header.Set("Range", test.rangeHeader)
+		}
+		if test.ifRange != "" {
+			req.Header.Set("If-Range", test.ifRange)
+		}
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		res := resp.Result()
+
+		body := resp.Body.Bytes()
+		if test.contentEncoding == "gzip" {
+			body = MustGunzip(body)
+		}
+
+		assert.Equal(t, test.code, res.StatusCode, "for Range %q and If-Range %q", test.rangeHeader, test.ifRange)
+		assert.Equal(t, test.contentEncoding, res.Header.Get("Content-Encoding"), "for Range %q and If-Range %q", test.rangeHeader, test.ifRange)
+		assert.Equal(t, `"v1"`, res.Header.Get("ETag"), "for Range %q and If-Range %q", test.rangeHeader, test.ifRange)
+		assert.Equal(t, test.body, string(body), "for Range %q and If-Range %q", test.rangeHeader, test.ifRange)
+	}
+}
+
+func TestReverseProxyContentEncoding(t *testing.T) {
+	// Random data doesn't compress, so the upstream
+	// response is larger than the minimum size.
+	data := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(data)
+	upstreamBody := gzipStrLevel(string(data), gzip.DefaultCompression)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", strconv.Itoa(len(upstreamBody)))
+		w.Write(upstreamBody)
+	}))
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing upstream URL: %v", err)
+	}
+
+	handler := Gzip(httputil.NewSingleHostReverseProxy(u))
+
+	req, _ := http.NewRequest("GET", "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	res := resp.Result()
+
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, []string{"gzip"}, res.Header["Content-Encoding"])
+	assert.Equal(t, upstreamBody, resp.Body.Bytes())
+}
+
+func TestFlushOnClose(t *testing.T) {
+	errFlush := errors.New("flush failed")
+
+	for _, body := range []string{"test", testBody} {
+		var closeErr error
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, body)
+			closeErr = w.(io.Closer).Close()
+		}), &Options{
+			Level:        DefaultCompression,
+			MinSize:      defaultMinSize,
+			FlushOnClose: true,
+		})
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := &flushErrorRecorder{httptest.NewRecorder(), errFlush}
+		handler.ServeHTTP(resp, req)
+
+		assert.True(t, errors.Is(closeErr, errFlush), "for body of length %d", len(body))
+		assert.True(t, resp.Flushed, "for body of length %d", len(body))
+	}
+}
+
+func TestFlushOnCloseOnError(t *testing.T) {
+	errFlush := errors.New("flush failed")
+
+	for _, explicitClose := range []bool{false, true} {
+		var errs []error
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, testBody)
+			if explicitClose {
+				w.(io.Closer).Close()
+			}
+		}), &Options{
+			Level:        DefaultCompression,
+			MinSize:      defaultMinSize,
+			FlushOnClose: true,
+			OnError: func(r *http.Request, err error) {
+				errs = append(errs, err)
+			},
+		})
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := &flushErrorRecorder{httptest.NewRecorder(), errFlush}
+		handler.ServeHTTP(resp, req)
+
+		// A handler that closes the response sees the error
+		// itself, so it isn't reported again.
+		if explicitClose {
+			assert.Empty(t, errs, "for explicit Close")
+		} else if assert.Len(t, errs, 1, "for implicit Close") {
+			assert.True(t, errors.Is(errs[0], errFlush), "for implicit Close")
+		}
+	}
+}
+
+func TestFlushBareResponseWriter(t *testing.T) {
+	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, ok := w.(http.Hijacker)
+		assert.False(t, ok, "http.ResponseWriter should not be an http.Hijacker")
+		_, ok = w.(http.Pusher)
+		assert.False(t, ok, "http.ResponseWriter should not be an http.Pusher")
+		_, ok = w.(http.CloseNotifier)
+		assert.False(t, ok, "http.ResponseWriter should not be an http.CloseNotifier")
+
+		f, ok := w.(http.Flusher)
+		if !assert.True(t, ok, "http.ResponseWriter should be an http.Flusher") {
+			return
+		}
+
+		f.Flush()
+		io.WriteString(w, testBody[:defaultMinSize])
+		f.Flush()
+		io.WriteString(w, testBody[defaultMinSize:])
+		f.Flush()
+		w.(io.Closer).Close()
+		f.Flush()
+	}))
+
+	req, _ := http.NewRequest("GET", "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := &bareResponseWriter{header: make(http.Header)}
+	handler.ServeHTTP(resp, req)
+
+	assert.Equal(t, "gzip", resp.header.Get("Content-Encoding"))
+	assert.Equal(t, testBody, string(MustGunzip(resp.body.Bytes())))
+}
+
+func TestFlushBuffered(t *testing.T) {
+	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "data: hello\n\n")
+		w.(http.Flusher).Flush()
+		io.WriteString(w, testBody)
+	}))
+
+	req, _ := http.NewRequest("GET", "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	assert.True(t, resp.Flushed)
+	assert.Empty(t, resp.Header().Get("Content-Encoding"))
+	assert.Equal(t, "text/plain; charset=utf-8", resp.Header().Get("Content-Type"))
+	assert.Equal(t, "data: hello\n\n"+testBody, resp.Body.String())
+}
+
+func TestFlushAcrossMinSize(t *testing.T) {
+	long := testBody + testBody[:5]
+	for _, test := range []struct {
+		first, second   string
+		contentEncoding string
+	}{
+		{testBody[:5], long, ""},
+		{long, testBody[:5], "gzip"},
+	} {
+		var states []writerState
+		handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gw := w.(*responseWriter)
+
+			io.WriteString(w, test.first)
+			w.(http.Flusher).Flush()
+			states = append(states, gw.state)
+
+			io.WriteString(w, test.second)
+			w.(http.Flusher).Flush()
+			states = append(states, gw.state)
+		}))
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+
+		body := resp.Body.Bytes()
+		if test.contentEncoding == "gzip" {
+			body = MustGunzip(body)
+		}
+
+		assert.Equal(t, states[0], states[1], "for writes of %d and %d bytes", len(test.first), len(test.second))
+		assert.Equal(t, test.contentEncoding, resp.Header().Get("Content-Encoding"), "for writes of %d and %d bytes", len(test.first), len(test.second))
+		assert.Equal(t, test.first+test.second, string(body), "for writes of %d and %d bytes", len(test.first), len(test.second))
+	}
+}
+
+func TestMultipartStream(t *testing.T) {
+	frame := bytes.Repeat([]byte{0xff, 0xd8, 0xff, 0xe0}, 200)
+	part := "--frame\r\nContent-Type: image/jpeg\r\n\r\n" + string(frame) + "\r\n"
+
+	resp := httptest.NewRecorder()
+	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary=frame")
+
+		for i := 1; i <= 2; i++ {
+			io.WriteString(w, part)
+			w.(http.Flusher).Flush()
+
+			assert.True(t, resp.Flushed, "Flush should flush the underlying response")
+			assert.Equal(t, strings.Repeat(part, i), resp.Body.String(), "part %d should be sent when flushed", i)
+		}
+	}))
+
+	req, _ := http.NewRequest("GET", "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	handler.ServeHTTP(resp, req)
+
+	assert.Empty(t, resp.Header().Get("Content-Encoding"))
+	assert.Equal(t, strings.Repeat(part, 2), resp.Body.String())
+}
+
+func TestFlushHeaderOnly(t *testing.T) {
+	resp := httptest.NewRecorder()
+	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusAccepted)
+		w.(http.Flusher).Flush()
+
+		assert.True(t, resp.Flushed, "Flush should flush the underlying response")
+		assert.Equal(t, http.StatusAccepted, resp.Code, "Flush should send the response code")
+	}))
+
+	req, _ := http.NewRequest("GET", "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	handler.ServeHTTP(resp, req)
+
+	assert.Empty(t, resp.Header().Get("Content-Encoding"))
+	assert.Equal(t, "text/event-stream", resp.Header().Get("Content-Type"))
+}
+
+func TestFlushBeforeWriteHeader(t *testing.T) {
+	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+		io.WriteString(w, testBody)
+	}))
+
+	req, _ := http.NewRequest("GET", "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	assert.False(t, resp.Flushed)
+	assert.Equal(t, "gzip", resp.Header().Get("Content-Encoding"))
+	assert.Equal(t, testBody, string(MustGunzip(resp.Body.Bytes())))
+}
+
+func TestStatsCompressDuration(t *testing.T) {
+	for _, test := range []struct {
+		body       string
+		compressed bool
+	}{
+		{testBody, true},
+		{"test", false},
+	} {
+		var (
+			stats  Stats
+			called int
+		)
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, test.body)
+		}), &Options{
+			Level:   DefaultCompression,
+			MinSize: defaultMinSize,
+			Stats: func(r *http.Request, s Stats) {
+				stats = s
+				called++
+			},
+		})
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+
+		assert.Equal(t, 1, called, "for body of length %d", len(test.body))
+		assert.Equal(t, test.compressed, stats.Compressed, "for body of length %d", len(test.body))
+		assert.Equal(t, test.compressed, stats.CompressDuration > 0, "for body of length %d", len(test.body))
+	}
+}
+
+func TestStatsReason(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		acceptEncoding string
+		body           string
+		opts           Options
+		before         func(w http.ResponseWriter)
+		encoding       string
+		reason         Reason
+	}{
+		{"compressed", "gzip", testBody, Options{}, nil, "gzip", ReasonNone},
+		{"not accepted", "identity", testBody, Options{}, nil, "identity", ReasonNotAccepted},
+		{"too small", "gzip", "test", Options{}, nil, "identity", ReasonTooSmall},
+		{"declared too small", "gzip", "test", Options{}, func(w http.ResponseWriter) {
+			w.Header().Set("Content-Length", "4")
+		}, "identity", ReasonTooSmall},
+		{"flushed too small", "gzip", "test", Options{}, func(w http.ResponseWriter) {
+			io.WriteString(w, "test")
+			w.(http.Flusher).Flush()
+		}, "identity", ReasonTooSmall},
+		{"denied", "gzip", testBody, Options{
+			CanCompress: func(http.Header) bool { return false },
+		}, nil, "identity", ReasonDenied},
+		{"already encoded", "gzip", testBody, Options{}, func(w http.ResponseWriter) {
+			w.Header().Set("Content-Encoding", "br")
+		}, "identity", ReasonDenied},
+		{"error", "gzip", testBody, Options{
+			NewWriter: func(w io.Writer, level int) (GzipWriter, error) {
+				return nil, errors.New("no writer")
+			},
+		}, nil, "identity", ReasonError},
+	} {
+		var stats Stats
+		opts := test.opts
+		opts.Level = DefaultCompression
+		opts.MinSize = defaultMinSize
+		opts.Stats = func(r *http.Request, s Stats) { stats = s }
+
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if test.before != nil {
+				test.before(w)
+			}
+			io.WriteString(w, test.body)
+		}), &opts)
+
+		req := httptest.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+
+		assert.Equal(t, test.encoding == "gzip", stats.Compressed, "for %s", test.name)
+		assert.Equal(t, test.encoding, stats.Encoding, "for %s", test.name)
+		assert.Equal(t, test.reason, stats.Reason, "for %s: got %v", test.name, stats.Reason)
+	}
+}
+
+func TestTap(t *testing.T) {
+	large := strings.Repeat(testBody, 4)
+	for _, test := range []struct {
+		body            string
+		readFrom        bool
+		contentEncoding string
+	}{
+		{large, false, "gzip"},
+		{large, true, "gzip"},
+		{"test", false, ""},
+		{"test", true, ""},
+	} {
+		var tap bytes.Buffer
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if test.readFrom {
+				w.(io.ReaderFrom).ReadFrom(strings.NewReader(test.body))
+				return
+			}
+
+			for body := test.body; body != ""; {
+				n := min(len(body), 100)
+				io.WriteString(w, body[:n])
+				body = body[n:]
+			}
+		}), &Options{
+			Level:   DefaultCompression,
+			MinSize: defaultMinSize,
+			Tap:     &tap,
+		})
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+
+		assert.Equal(t, test.contentEncoding, resp.Header().Get("Content-Encoding"),
+			"for body of length %d and ReadFrom %t", len(test.body), test.readFrom)
+		assert.Equal(t, test.body, tap.String(),
+			"for body of length %d and ReadFrom %t", len(test.body), test.readFrom)
+	}
+}
+
+func TestTapError(t *testing.T) {
+	errTap := errors.New("tap failed")
+
+	var errs []error
+	handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.WriteString(w, testBody)
+		assert.NoError(t, err, "a failing tap should not fail the response")
+	}), &Options{
+		Level:   DefaultCompression,
+		MinSize: defaultMinSize,
+		Tap:     errorWriter{err: errTap},
+		OnError: func(r *http.Request, err error) {
+			errs = append(errs, err)
+		},
+	})
+
+	req, _ := http.NewRequest("GET", "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	assert.Equal(t, testBody, string(MustGunzip(resp.Body.Bytes())))
+	assert.Equal(t, []error{errTap}, errs)
+}
+
+func TestAuditLog(t *testing.T) {
+	var log bytes.Buffer
+	handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/small" {
+			io.WriteString(w, "test")
+		} else {
+			io.WriteString(w, testBody)
+		}
+	}), &Options{
+		Level:    DefaultCompression,
+		MinSize:  defaultMinSize,
+		AuditLog: &log,
+	})
+
+	for _, path := range []string{"/large", "/small"} {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	type record struct {
+		Method   string `json:"method"`
+		Path     string `json:"path"`
+		Encoding string `json:"encoding"`
+		Size     int64  `json:"size"`
+		SentSize int64  `json:"sent_size"`
+	}
+
+	dec := json.NewDecoder(&log)
+
+	var large, small record
+	assert.NoError(t, dec.Decode(&large))
+	assert.NoError(t, dec.Decode(&small))
+	assert.Equal(t, io.EOF, dec.Decode(new(record)))
+
+	assert.Equal(t, record{
+		Method:   "GET",
+		Path:     "/large",
+		Encoding: "gzip",
+		Size:     int64(len(testBody)),
+		SentSize: int64(len(gzipStrLevel(testBody, gzip.DefaultCompression))),
+	}, large)
+	assert.Equal(t, record{
+		Method:   "GET",
+		Path:     "/small",
+		Encoding: "identity",
+		Size:     4,
+		SentSize: 4,
+	}, small)
+}
+
+func TestOnPush(t *testing.T) {
+	handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := w.(http.Pusher)
+		if !assert.True(t, ok, "http.ResponseWriter should be an http.Pusher") {
+			return
+		}
+
+		assert.NoError(t, p.Push("/style.css", nil))
+		assert.NoError(t, p.Push("/logo.png", &http.PushOptions{Method: "GET"}))
+		io.WriteString(w, testBody)
+	}), &Options{
+		Level:   DefaultCompression,
+		MinSize: defaultMinSize,
+		OnPush: func(target string, opts *http.PushOptions) {
+			opts.Header = make(http.Header)
+			if target == "/logo.png" {
+				opts.Header.Set("Accept-Encoding", "identity")
+			} else {
+				opts.Header.Set("Accept-Encoding", "gzip")
+			}
+		},
+	})
+
+	req, _ := http.NewRequest("GET", "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	handler.ServeHTTP(resp, req)
+
+	assert.Equal(t, []string{"/style.css", "/logo.png"}, resp.targets)
+	if assert.Len(t, resp.opts, 2) {
+		assert.Equal(t, "gzip", resp.opts[0].Header.Get("Accept-Encoding"))
+		assert.Equal(t, "identity", resp.opts[1].Header.Get("Accept-Encoding"))
+		assert.Equal(t, "GET", resp.opts[1].Method)
+	}
+}
+
+func TestOptionalInterfaces(t *testing.T) {
+	for _, test := range []struct {
+		w http.ResponseWriter
+
+		closeNotifier, hijacker, pusher bool
+	}{
+		{httptest.NewRecorder(), false, false, false},
+		{&closeNotifyRecorder{ResponseRecorder: httptest.NewRecorder()}, true, false, false},
+		{&hijackRecorder{ResponseRecorder: httptest.NewRecorder()}, false, true, false},
+		{&pushRecorder{ResponseRecorder: httptest.NewRecorder()}, false, false, true},
+		{&allInterfacesRecorder{closeNotifyRecorder: closeNotifyRecorder{ResponseRecorder: httptest.NewRecorder()}}, true, true, true},
+	} {
+		handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, ok := w.(http.CloseNotifier)
+			assert.Equal(t, test.closeNotifier, ok, "http.CloseNotifier for %T", test.w)
+			_, ok = w.(http.Hijacker)
+			assert.Equal(t, test.hijacker, ok, "http.Hijacker for %T", test.w)
+			_, ok = w.(http.Pusher)
+			assert.Equal(t, test.pusher, ok, "http.Pusher for %T", test.w)
+			_, ok = w.(http.Flusher)
+			assert.True(t, ok, "http.Flusher for %T", test.w)
+
+			io.WriteString(w, testBody)
+		}))
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		handler.ServeHTTP(test.w, req)
+	}
+}
+
+func TestResponseWriterInterface(t *testing.T) {
+	for _, w := range []http.ResponseWriter{
+		httptest.NewRecorder(),
+		&bareResponseWriter{header: make(http.Header)},
+		&pushRecorder{ResponseRecorder: httptest.NewRecorder()},
+		&allInterfacesRecorder{closeNotifyRecorder: closeNotifyRecorder{ResponseRecorder: httptest.NewRecorder()}},
+	} {
+		handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rw, ok := w.(ResponseWriter)
+			if !assert.True(t, ok, "http.ResponseWriter should be a ResponseWriter") {
+				return
+			}
+
+			io.WriteString(rw, testBody)
+			assert.NoError(t, rw.Close())
+
+			_, err := io.WriteString(rw, testBody)
+			assert.Equal(t, ErrWriteAfterClose, err)
+		}))
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		handler.ServeHTTP(w, req)
+	}
+}
+
+func TestOptionalInterfacesForward(t *testing.T) {
+	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.(http.CloseNotifier).CloseNotify()
+		w.(http.Hijacker).Hijack()
+		assert.NoError(t, w.(http.Pusher).Push("/style.css", nil))
+
+		// Methods the wrapper doesn't implement are
+		// reached through Unwrap.
+		err := http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		assert.NoError(t, err)
+	}))
+
+	req, _ := http.NewRequest("GET", "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := &allInterfacesRecorder{closeNotifyRecorder: closeNotifyRecorder{ResponseRecorder: httptest.NewRecorder()}}
+	handler.ServeHTTP(resp, req)
+
+	assert.True(t, resp.closeNotified)
+	assert.True(t, resp.hijacked)
+	assert.Equal(t, []string{"/style.css"}, resp.targets)
+	assert.True(t, resp.deadlineSet)
+}
+
+func TestHTTP3(t *testing.T) {
+	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, ok := w.(http.Hijacker)
+		assert.False(t, ok, "http.ResponseWriter should not be an http.Hijacker")
+		_, ok = w.(http.CloseNotifier)
+		assert.False(t, ok, "http.ResponseWriter should not be an http.CloseNotifier")
+
+		// HTTP/3 servers find their own interfaces by
+		// unwrapping the writer.
+		var stream interface{ HTTPStream() }
+		for rw := w; stream == nil; {
+			stream, _ = rw.(interface{ HTTPStream() })
+			u, ok := rw.(interface{ Unwrap() http.ResponseWriter })
+			if !ok {
+				break
+			}
+			rw = u.Unwrap()
+		}
+		assert.NotNil(t, stream, "should unwrap to the HTTP/3 writer")
+
+		io.WriteString(w, testBody)
+		w.(http.Flusher).Flush()
+	}))
+
+	req, _ := http.NewRequest("GET", "/whatever", nil)
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/3.0", 3, 0
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := &h3ResponseWriter{ResponseRecorder: httptest.NewRecorder()}
+	handler.ServeHTTP(resp, req)
+
+	res := resp.Result()
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, testBody, string(MustGunzip(resp.Body.Bytes())))
+	assert.True(t, resp.Flushed)
+}
+
+func TestStatusCodes(t *testing.T) {
+	handler := Gzip(http.NotFoundHandler())
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	result := w.Result()
+	if result.StatusCode != 404 {
+		t.Errorf("StatusCode should have been 404 but was %d", result.StatusCode)
+	}
+}
+
+func TestHTTPError(t *testing.T) {
+	for _, test := range []struct {
+		msg             string
+		contentEncoding string
+	}{
+		{"bad request", ""},
+		{testBody, "gzip"},
+	} {
+		handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, test.msg, http.StatusBadRequest)
+		}))
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		res := resp.Result()
+
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+		assert.Equal(t, test.contentEncoding, res.Header.Get("Content-Encoding"))
+		assert.Equal(t, "text/plain; charset=utf-8", res.Header.Get("Content-Type"))
+		assert.Equal(t, "nosniff", res.Header.Get("X-Content-Type-Options"))
+
+		if test.contentEncoding == "gzip" {
+			assert.Equal(t, gzipStrLevel(test.msg+"\n", gzip.DefaultCompression), resp.Body.Bytes())
+		} else {
+			assert.Equal(t, test.msg+"\n", resp.Body.String())
+		}
+	}
+}
+
+func TestContentTypeRewrite(t *testing.T) {
+	for _, test := range []struct {
+		contentType    string
+		body           string
+		acceptEncoding string
+		expect         string
+	}{
+		{"application/json", testBody, "gzip", "application/json; charset=utf-8"},
+		{"application/json", "{}", "gzip", "application/json; charset=utf-8"},
+		{"application/json", testBody, "", "application/json; charset=utf-8"},
+		{"application/json; charset=utf-8", testBody, "gzip", "application/json; charset=utf-8"},
+		{"text/html", testBody, "gzip", "text/html"},
+		{"", "<html></html>", "gzip", "text/html; charset=utf-8"},
+	} {
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if test.contentType != "" {
+				w.Header().Set("Content-Type", test.contentType)
+			}
+			io.WriteString(w, test.body)
+		}), &Options{
+			Level:   DefaultCompression,
+			MinSize: defaultMinSize,
+			ContentTypeRewrite: func(ct string) string {
+				if ct == "application/json" {
+					return "application/json; charset=utf-8"
+				}
+				return ct
+			},
+		})
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		if test.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		}
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+
+		assert.Equal(t, test.expect, resp.Header().Get("Content-Type"),
+			"for Content-Type %q, body of length %d and Accept-Encoding %q", test.contentType, len(test.body), test.acceptEncoding)
+	}
+}
+
+func TestInferContentType(t *testing.T) {
+	handler := GzipWithLevelAndMinSize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "<!doc")
+		io.WriteString(w, "type html>")
+	}), gzip.DefaultCompression, len("<!doctype html"))
+
+	req1, _ := http.NewRequest("GET", "/whatever", nil)
+	req1.Header.Add("Accept-Encoding", "gzip")
+	resp1 := httptest.NewRecorder()
+	handler.ServeHTTP(resp1, req1)
+	res1 := resp1.Result()
+
+	const expect = "text/html; charset=utf-8"
+	if ct := res1.Header.Get("Content-Type"); ct != expect {
+		t.Error("Infering Content-Type failed for buffered response")
+		t.Logf("Expected: %s", expect)
+		t.Logf("Got:      %s", ct)
+	}
+}
+
+func TestInferContentTypeUncompressed(t *testing.T) {
+	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		io.WriteString(w, "<!doctype html>")
 	}))
 
@@ -325,62 +3913,304 @@ func TestPassThroughBigWrite(t *testing.T) {
 		CanCompress: func(http.Header) bool { return false },
 	})
 
-	// Run a test with size bigger than the limit
-	b := bytes.NewBufferString("01234567890123")
+	// Run a test with size bigger than the limit
+	b := bytes.NewBufferString("01234567890123")
+
+	req, _ := http.NewRequest("GET", "/whatever", b)
+	req.Header.Add("Accept-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	res1 := resp.Result()
+
+	if res1.Header.Get("Content-Encoding") == "gzip" {
+		t.Errorf("The response is compress and should not")
+		return
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Unexpected error reading response body: %v", err)
+	}
+
+	assert.Equal(t, string(body), "01234567890123")
+}
+
+func TestPassThroughSmallWrites(t *testing.T) {
+	handler := GzipWithOptions(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			resp, _ := ioutil.ReadAll(r.Body)
+			w.Write(resp)
+			w.Write(resp)
+			w.Write(resp)
+		},
+	), &Options{
+		Level:       DefaultCompression,
+		MinSize:     10,
+		CanCompress: func(http.Header) bool { return false },
+	})
+
+	// Run a test with size smaller than the limit
+	b := bytes.NewBufferString("012345678")
+
+	req, _ := http.NewRequest("GET", "/whatever", b)
+	req.Header.Add("Accept-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	res1 := resp.Result()
+
+	if res1.Header.Get("Content-Encoding") == "gzip" {
+		t.Errorf("The response is compress and should not")
+		return
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Unexpected error reading response body: %v", err)
+	}
+
+	assert.Equal(t, string(body), "012345678012345678012345678")
+}
+
+func TestCanCompressFull(t *testing.T) {
+	for _, test := range []struct {
+		path            string
+		contentEncoding string
+	}{
+		{"/api/text", "gzip"},
+		{"/api/binary", ""},
+	} {
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, testBody)
+		}), &Options{
+			Level:   DefaultCompression,
+			MinSize: defaultMinSize,
+			CanCompress: func(http.Header) bool {
+				t.Error("CanCompress called when CanCompressFull was set")
+				return false
+			},
+			CanCompressFull: func(r *http.Request, _ http.Header) bool {
+				return r.URL.Path != "/api/binary"
+			},
+		})
+
+		req, _ := http.NewRequest("GET", test.path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		res := resp.Result()
+
+		assert.Equal(t, test.contentEncoding, res.Header.Get("Content-Encoding"), "for path %s", test.path)
+	}
+}
+
+func TestOnlyCacheable(t *testing.T) {
+	for _, test := range []struct {
+		cacheControl    string
+		etag            string
+		contentEncoding string
+	}{
+		{"public, max-age=3600", "", "gzip"},
+		{"", `"abc"`, "gzip"},
+		{"no-store", "", ""},
+		{"public, no-store", `"abc"`, ""},
+		{"max-age=3600", "", ""},
+	} {
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if test.cacheControl != "" {
+				w.Header().Set("Cache-Control", test.cacheControl)
+			}
+			if test.etag != "" {
+				w.Header().Set("ETag", test.etag)
+			}
+			io.WriteString(w, testBody)
+		}), &Options{
+			Level:         DefaultCompression,
+			MinSize:       defaultMinSize,
+			OnlyCacheable: true,
+		})
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		res := resp.Result()
+
+		assert.Equal(t, test.contentEncoding, res.Header.Get("Content-Encoding"),
+			"for Cache-Control %q and ETag %q", test.cacheControl, test.etag)
+	}
+}
+
+func TestDisableContentTypeSniff(t *testing.T) {
+	for _, body := range []string{"<!doctype html>", "<!doctype html>" + testBody} {
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, body)
+		}), &Options{
+			Level:                   DefaultCompression,
+			MinSize:                 defaultMinSize,
+			DisableContentTypeSniff: true,
+		})
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := &headerSnapshotRecorder{ResponseRecorder: httptest.NewRecorder()}
+		handler.ServeHTTP(resp, req)
+
+		_, ok := resp.snapshot["Content-Type"]
+		assert.False(t, ok, "Content-Type was set for body of length %d", len(body))
+	}
+}
+
+func TestSniffText(t *testing.T) {
+	binary := make([]byte, len(testBody))
+	rand.New(rand.NewSource(1)).Read(binary)
+
+	for _, test := range []struct {
+		name            string
+		body            []byte
+		contentEncoding string
+	}{
+		{"text", []byte(testBody), "gzip"},
+		{"binary", binary, ""},
+	} {
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(test.body)
+		}), &Options{
+			Level:       DefaultCompression,
+			MinSize:     defaultMinSize,
+			CanCompress: DefaultCompressiblePredicate,
+			SniffText:   true,
+		})
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		res := resp.Result()
+
+		assert.Equal(t, test.contentEncoding, res.Header.Get("Content-Encoding"), "for %s body", test.name)
+	}
+}
+
+func TestNoBuffer(t *testing.T) {
+	for _, test := range []struct {
+		name            string
+		handler         http.HandlerFunc
+		code            int
+		contentEncoding string
+		body            string
+	}{
+		{"small", func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "test")
+		}, http.StatusOK, "gzip", "test"},
+		{"declared-small", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "4")
+			io.WriteString(w, "test")
+		}, http.StatusOK, "", "test"},
+		{"empty", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		}, http.StatusNotFound, "", ""},
+	} {
+		handler := GzipWithOptions(test.handler, &Options{
+			Level:    DefaultCompression,
+			MinSize:  defaultMinSize,
+			NoBuffer: true,
+		})
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		res := resp.Result()
+
+		assert.Equal(t, test.code, res.StatusCode, "for %s", test.name)
+		assert.Equal(t, test.contentEncoding, res.Header.Get("Content-Encoding"), "for %s", test.name)
+
+		if test.contentEncoding == "gzip" {
+			assert.Equal(t, test.body, string(MustGunzip(resp.Body.Bytes())), "for %s", test.name)
+		} else {
+			assert.Equal(t, test.body, resp.Body.String(), "for %s", test.name)
+		}
+	}
+}
+
+func TestSampleRatio(t *testing.T) {
+	data := make([]byte, 2048)
+	rand.New(rand.NewSource(1)).Read(data)
 
-	req, _ := http.NewRequest("GET", "/whatever", b)
-	req.Header.Add("Accept-Encoding", "gzip")
-	resp := httptest.NewRecorder()
-	handler.ServeHTTP(resp, req)
-	res1 := resp.Result()
+	for _, test := range []struct {
+		name            string
+		body            string
+		contentEncoding string
+	}{
+		{"data-uri", ".logo{background:url(data:image/png;base64," + base64.StdEncoding.EncodeToString(data) + ")}", ""},
+		{"normal", strings.Repeat(".btn{color:#333;padding:4px 8px;margin:0}\n", 50), "gzip"},
+	} {
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/css")
+			io.WriteString(w, test.body)
+		}), &Options{
+			Level:       DefaultCompression,
+			MinSize:     defaultMinSize,
+			SampleRatio: 0.9,
+		})
 
-	if res1.Header.Get("Content-Encoding") == "gzip" {
-		t.Errorf("The response is compress and should not")
-		return
-	}
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		res := resp.Result()
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		t.Fatalf("Unexpected error reading response body: %v", err)
-	}
+		assert.Equal(t, test.contentEncoding, res.Header.Get("Content-Encoding"), "for %s CSS", test.name)
 
-	assert.Equal(t, string(body), "01234567890123")
-}
+		if test.contentEncoding == "gzip" {
+			assert.Equal(t, test.body, string(MustGunzip(resp.Body.Bytes())), "for %s CSS", test.name)
+		} else {
+			assert.Equal(t, test.body, resp.Body.String(), "for %s CSS", test.name)
+		}
+	}
 
-func TestPassThroughSmallWrites(t *testing.T) {
-	handler := GzipWithOptions(http.HandlerFunc(
-		func(w http.ResponseWriter, r *http.Request) {
-			resp, _ := ioutil.ReadAll(r.Body)
-			w.Write(resp)
-			w.Write(resp)
-			w.Write(resp)
-		},
-	), &Options{
-		Level:       DefaultCompression,
-		MinSize:     10,
-		CanCompress: func(http.Header) bool { return false },
+	assertPanicsWith(t, ErrNegativeSampleRatio, func() {
+		GzipWithOptions(nil, &Options{Level: DefaultCompression, SampleRatio: -1})
 	})
+}
 
-	// Run a test with size smaller than the limit
-	b := bytes.NewBufferString("012345678")
+func TestSampleRatioSmallFirstWrite(t *testing.T) {
+	body := "[" + strings.Repeat(`{"id":1,"name":"gziphandler"},`, 400)
 
-	req, _ := http.NewRequest("GET", "/whatever", b)
-	req.Header.Add("Accept-Encoding", "gzip")
-	resp := httptest.NewRecorder()
-	handler.ServeHTTP(resp, req)
-	res1 := resp.Result()
+	for _, test := range []struct {
+		name     string
+		declared bool
+		noBuffer bool
+	}{
+		{"declared length", true, false},
+		{"NoBuffer", false, true},
+	} {
+		handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if test.declared {
+				w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			}
+			io.WriteString(w, body[:1])
+			io.WriteString(w, body[1:])
+		}), &Options{
+			Level:       DefaultCompression,
+			MinSize:     defaultMinSize,
+			NoBuffer:    test.noBuffer,
+			SampleRatio: 0.9,
+		})
 
-	if res1.Header.Get("Content-Encoding") == "gzip" {
-		t.Errorf("The response is compress and should not")
-		return
-	}
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		t.Fatalf("Unexpected error reading response body: %v", err)
+		// The one byte first write is too small a sample
+		// to judge the response by.
+		assert.Equal(t, "gzip", resp.Header().Get("Content-Encoding"), "for %s", test.name)
+		assert.True(t, resp.Body.Len() < len(body)/10, "for %s", test.name)
+		assert.Equal(t, body, string(MustGunzip(resp.Body.Bytes())), "for %s", test.name)
 	}
-
-	assert.Equal(t, string(body), "012345678012345678012345678")
 }
 
 // --------------------------------------------------------------------
@@ -392,6 +4222,172 @@ func BenchmarkGzipHandler_P2k(b *testing.B)   { benchmark(b, true, 2048) }
 func BenchmarkGzipHandler_P20k(b *testing.B)  { benchmark(b, true, 20480) }
 func BenchmarkGzipHandler_P100k(b *testing.B) { benchmark(b, true, 102400) }
 
+// fuzzRequestKey is the context key for the operations
+// and minimum size of a request in FuzzResponseWriter.
+type fuzzRequestKey struct{}
+
+type fuzzRequest struct {
+	ops     []byte
+	minSize int
+}
+
+// FuzzResponseWriter drives a response through the writer
+// with a sequence of operations, each encoded in a byte of
+// ops, and checks that the client receives exactly what
+// was written.
+func FuzzResponseWriter(f *testing.F) {
+	f.Add([]byte{0xfc, 0xfc}, uint16(defaultMinSize), false, false)
+	f.Add([]byte{0x14, 0x01, 0xfc, 0xfc, 0x03}, uint16(defaultMinSize), false, false)
+	f.Add([]byte{0x02, 0x00, 0x01, 0xfc, 0x03, 0x03}, uint16(0), true, false)
+	f.Add([]byte{0xfc, 0x01, 0x14, 0xfc}, uint16(defaultMinSize), false, true)
+
+	// The handlers are shared between inputs, as they
+	// would be by a server, so that their pools are
+	// reused.
+	var handlers [2]http.Handler
+	for i := range handlers {
+		handlers[i] = GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, op := range r.Context().Value(fuzzRequestKey{}).(*fuzzRequest).ops {
+				switch op & 3 {
+				case 0:
+					// Writes of 0 to 504 bytes.
+					io.WriteString(w, testBody[:int(op>>2)*8])
+				case 1:
+					w.(http.Flusher).Flush()
+				case 2:
+					w.WriteHeader(http.StatusOK)
+				case 3:
+					// Nothing may be written after Close,
+					// but it may be called again.
+					w.(io.Closer).Close()
+					w.(io.Closer).Close()
+					return
+				}
+			}
+		}), &Options{
+			Level: DefaultCompression,
+			MinSizeFunc: func(r *http.Request) int {
+				return r.Context().Value(fuzzRequestKey{}).(*fuzzRequest).minSize
+			},
+			NoBuffer:   i == 1,
+			HTTP10Mode: HTTP10Buffer,
+		})
+	}
+
+	f.Fuzz(func(t *testing.T, ops []byte, minSize uint16, noBuffer, http10Buffer bool) {
+		var want bytes.Buffer
+		for _, op := range ops {
+			if op&3 == 3 {
+				break
+			} else if op&3 == 0 {
+				want.WriteString(testBody[:int(op>>2)*8])
+			}
+		}
+
+		ctx := context.WithValue(context.Background(), fuzzRequestKey{}, &fuzzRequest{ops, int(minSize)})
+		req, _ := http.NewRequestWithContext(ctx, "GET", "/whatever", nil)
+		if http10Buffer {
+			req.Proto, req.ProtoMinor = "HTTP/1.0", 0
+		}
+		req.Header.Set("Accept-Encoding", "gzip")
+
+		handler := handlers[0]
+		if noBuffer {
+			handler = handlers[1]
+		}
+
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+
+		body := resp.Body.Bytes()
+		switch ce := resp.Header().Get("Content-Encoding"); ce {
+		case "gzip":
+			var err error
+			if body, err = GunzipBytes(body); err != nil {
+				t.Fatalf("invalid gzip response: %v", err)
+			}
+		case "":
+		default:
+			t.Fatalf("unexpected Content-Encoding %q", ce)
+		}
+
+		if !bytes.Equal(want.Bytes(), body) {
+			t.Fatalf("response body of %d bytes does not match the %d bytes written", len(body), want.Len())
+		}
+	})
+}
+
+func BenchmarkGzipHandler_Buffered(b *testing.B) { benchmarkBuffering(b, false) }
+func BenchmarkGzipHandler_NoBuffer(b *testing.B) { benchmarkBuffering(b, true) }
+
+func BenchmarkGzipHandler_SmallWrites(b *testing.B)        { benchmarkSmallWrites(b, false) }
+func BenchmarkGzipHandler_SmallWritesMinSize(b *testing.B) { benchmarkSmallWrites(b, true) }
+
+func BenchmarkGzipHandler_NotAccepted(b *testing.B) {
+	body := []byte(testBody)
+	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+
+	req, _ := http.NewRequest("GET", "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "identity")
+
+	// The response is passed through, so only the cost of
+	// the handler itself is measured.
+	w := &discardResponseWriter{header: make(http.Header)}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		clear(w.header)
+		handler.ServeHTTP(w, req)
+	}
+}
+
+func BenchmarkGzipHandler_CopyFile(b *testing.B)            { benchmarkCopyFile(b, "gzip") }
+func BenchmarkGzipHandler_CopyFilePassThrough(b *testing.B) { benchmarkCopyFile(b, "identity") }
+
+func BenchmarkGzipHandler_Stream(b *testing.B)         { benchmarkStream(b, 0) }
+func BenchmarkGzipHandler_StreamBuffered(b *testing.B) { benchmarkStream(b, 4096) }
+
+func BenchmarkNegotiate(b *testing.B) {
+	for _, ae := range []string{"gzip", "gzip, deflate, br", "br;q=1.0, gzip;q=0.8"} {
+		b.Run(ae, func(b *testing.B) {
+			hdr := http.Header{"Accept-Encoding": {ae}}
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				negotiate(hdr)
+			}
+		})
+	}
+}
+
+func BenchmarkGzipHandler_JSONStream(b *testing.B) {
+	type object struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}
+
+	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		enc := json.NewEncoder(w)
+		for i := 0; i < 10000; i++ {
+			enc.Encode(&object{i, "gziphandler"})
+		}
+	}))
+
+	req, _ := http.NewRequest("GET", "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		runBenchmark(b, req, handler)
+	}
+}
+
 // --------------------------------------------------------------------
 
 func gzipStrLevel(s string, lvl int) []byte {
@@ -427,6 +4423,160 @@ func benchmark(b *testing.B, parallel bool, size int) {
 	}
 }
 
+func benchmarkBuffering(b *testing.B, noBuffer bool) {
+	bin, err := ioutil.ReadFile("testdata/benchmark.json")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Write in small chunks, as a streaming reverse
+		// proxy might.
+		for data := bin[:20480]; len(data) != 0; data = data[128:] {
+			w.Write(data[:128])
+		}
+	}), &Options{
+		Level:    DefaultCompression,
+		MinSize:  defaultMinSize,
+		NoBuffer: noBuffer,
+	})
+
+	req, _ := http.NewRequest("GET", "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		runBenchmark(b, req, handler)
+	}
+}
+
+func benchmarkSmallWrites(b *testing.B, minSizeFunc bool) {
+	chunk := []byte(testBody[:50])
+
+	opts := &Options{
+		Level:   DefaultCompression,
+		MinSize: defaultMinSize,
+	}
+	if minSizeFunc {
+		// A larger minimum size than the handler's buffers
+		// were allocated for.
+		opts.MinSizeFunc = func(*http.Request) int {
+			return 8 * defaultMinSize
+		}
+	}
+
+	handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 10000; i++ {
+			w.Write(chunk)
+		}
+	}), opts)
+
+	req, _ := http.NewRequest("GET", "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		runBenchmark(b, req, handler)
+	}
+}
+
+func BenchmarkGzipHandler_Tiny(b *testing.B) {
+	body := []byte(`{"ok":true}`)
+	contentType := []string{"application/json"}
+	contentLength := []string{strconv.Itoa(len(body))}
+
+	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header()["Content-Type"] = contentType
+		w.Header()["Content-Length"] = contentLength
+		w.Write(body)
+	}))
+
+	req, _ := http.NewRequest("GET", "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		if res.Body.Len() != len(body) {
+			b.Fatalf("Expected %d byte response body, but got %d bytes", len(body), res.Body.Len())
+		}
+	}
+}
+
+func benchmarkCopyFile(b *testing.B, acceptEncoding string) {
+	// Serve the file from a real server, so that a
+	// response that is passed through may use sendfile.
+	srv := httptest.NewServer(Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, err := os.Open("testdata/benchmark.json")
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		defer f.Close()
+
+		w.Header().Set("Content-Type", "application/json")
+		io.Copy(w, f)
+	})))
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		res, err := client.Do(req)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		n, err := io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+		if err != nil {
+			b.Fatal(err)
+		} else if n < 500 {
+			b.Fatalf("Expected complete response body, but got %d bytes", n)
+		}
+	}
+}
+
+func benchmarkStream(b *testing.B, streamBufferSize int) {
+	bin, err := ioutil.ReadFile("testdata/benchmark.json")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	handler := GzipWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A large response, streamed in many writes.
+		for i := 0; i < 8; i++ {
+			w.Write(bin)
+		}
+	}), &Options{
+		Level:            DefaultCompression,
+		MinSize:          defaultMinSize,
+		StreamBufferSize: streamBufferSize,
+	})
+
+	req, _ := http.NewRequest("GET", "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	// The compressed response is discarded, so that only
+	// the memory held by the handler is measured.
+	w := &discardResponseWriter{header: make(http.Header)}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		clear(w.header)
+		handler.ServeHTTP(w, req)
+	}
+}
+
 func runBenchmark(b *testing.B, req *http.Request, handler http.Handler) {
 	res := httptest.NewRecorder()
 	handler.ServeHTTP(res, req)
@@ -442,3 +4592,201 @@ func newTestHandler(body string) http.Handler {
 		io.WriteString(w, body)
 	}))
 }
+
+// headerSnapshotRecorder records a copy of the headers when
+// WriteHeader is called, before httptest.ResponseRecorder
+// infers a Content-Type.
+type headerSnapshotRecorder struct {
+	*httptest.ResponseRecorder
+
+	snapshot http.Header
+}
+
+func (w *headerSnapshotRecorder) WriteHeader(code int) {
+	w.snapshot = w.Header().Clone()
+	w.ResponseRecorder.WriteHeader(code)
+}
+
+// flushErrorRecorder is an httptest.ResponseRecorder
+// with a FlushError method that always fails.
+type flushErrorRecorder struct {
+	*httptest.ResponseRecorder
+
+	err error
+}
+
+func (w *flushErrorRecorder) FlushError() error {
+	w.ResponseRecorder.Flush()
+	return w.err
+}
+
+// writeErrorRecorder is an httptest.ResponseRecorder
+// whose writes always fail.
+type writeErrorRecorder struct {
+	*httptest.ResponseRecorder
+
+	err error
+}
+
+func (w *writeErrorRecorder) Write(b []byte) (int, error) {
+	return 0, w.err
+}
+
+// failingGzipWriter is a GzipWriter that never writes
+// anything. Its writes succeed ok times and then fail.
+type failingGzipWriter struct {
+	err error
+	ok  int
+}
+
+func (*failingGzipWriter) Flush() error      { return nil }
+func (*failingGzipWriter) Close() error      { return nil }
+func (*failingGzipWriter) Reset(w io.Writer) {}
+
+func (w *failingGzipWriter) Write(b []byte) (int, error) {
+	if w.ok == 0 {
+		return 0, w.err
+	}
+
+	w.ok--
+	return len(b), nil
+}
+
+// bareResponseWriter is an http.ResponseWriter that
+// implements none of the optional interfaces.
+type bareResponseWriter struct {
+	header http.Header
+	body   bytes.Buffer
+	code   int
+}
+
+func (w *bareResponseWriter) Header() http.Header { return w.header }
+
+func (w *bareResponseWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+
+	return w.body.Write(b)
+}
+
+func (w *bareResponseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+// writeSizeRecorder is an httptest.ResponseRecorder that
+// records the size of each write to it.
+type writeSizeRecorder struct {
+	*httptest.ResponseRecorder
+
+	sizes []int
+}
+
+func (w *writeSizeRecorder) Write(b []byte) (int, error) {
+	w.sizes = append(w.sizes, len(b))
+	return w.ResponseRecorder.Write(b)
+}
+
+// discardResponseWriter is an http.ResponseWriter that
+// discards the response body.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header         { return w.header }
+func (w *discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardResponseWriter) WriteHeader(int)             {}
+
+// pushRecorder is an httptest.ResponseRecorder that
+// records the pushes initiated by the handler.
+type pushRecorder struct {
+	*httptest.ResponseRecorder
+
+	targets []string
+	opts    []*http.PushOptions
+}
+
+func (w *pushRecorder) Push(target string, opts *http.PushOptions) error {
+	w.targets = append(w.targets, target)
+	w.opts = append(w.opts, opts)
+	return nil
+}
+
+// h3ResponseWriter is an httptest.ResponseRecorder that,
+// like the ResponseWriter of an HTTP/3 server, implements
+// http.Flusher and an HTTPStream method but none of
+// http.CloseNotifier, http.Hijacker or http.Pusher.
+type h3ResponseWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (*h3ResponseWriter) HTTPStream() {}
+
+// closeNotifyRecorder is an httptest.ResponseRecorder that
+// implements http.CloseNotifier.
+type closeNotifyRecorder struct {
+	*httptest.ResponseRecorder
+
+	closeNotified bool
+}
+
+func (w *closeNotifyRecorder) CloseNotify() <-chan bool {
+	w.closeNotified = true
+	return make(chan bool)
+}
+
+// hijackRecorder is an httptest.ResponseRecorder that
+// implements http.Hijacker.
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+
+	hijacked bool
+}
+
+func (w *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	return nil, nil, nil
+}
+
+// allInterfacesRecorder is an httptest.ResponseRecorder
+// that implements http.CloseNotifier, http.Hijacker and
+// http.Pusher, and records write deadlines.
+type allInterfacesRecorder struct {
+	closeNotifyRecorder
+
+	hijacked    bool
+	targets     []string
+	deadlineSet bool
+}
+
+func (w *allInterfacesRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	return nil, nil, nil
+}
+
+func (w *allInterfacesRecorder) Push(target string, opts *http.PushOptions) error {
+	w.targets = append(w.targets, target)
+	return nil
+}
+
+func (w *allInterfacesRecorder) SetWriteDeadline(time.Time) error {
+	w.deadlineSet = true
+	return nil
+}
+
+// assertPanicsWith asserts that f panics with an error
+// that matches target.
+func assertPanicsWith(t *testing.T, target error, f func()) {
+	t.Helper()
+
+	defer func() {
+		t.Helper()
+
+		err, _ := recover().(error)
+		assert.True(t, errors.Is(err, target), "expected panic with %v, got %v", target, err)
+	}()
+
+	f()
+}
@@ -0,0 +1,218 @@
+package gziphandler
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/golang/gddo/httputil/header"
+)
+
+// negotiate returns the gzip content coding as it appears
+// in the Accept-Encoding header of the request, or an
+// empty string if the client does not accept gzip. If
+// gzip is only accepted by a * entry, it returns "gzip".
+// It agrees with Negotiate offered only gzip.
+//
+// Only gzip is implemented, so a client that accepts
+// deflate but not gzip is never compressed; sending it a
+// gzip stream would mislabel the response.
+func negotiate(hdr http.Header) string {
+	// Fast path for the most common values, which avoids
+	// the allocations of header.ParseAccept.
+	if ae := hdr["Accept-Encoding"]; len(ae) == 1 {
+		switch ae[0] {
+		case "gzip", "gzip, deflate", "gzip, deflate, br":
+			return "gzip"
+		}
+	}
+
+	specs := header.ParseAccept(hdr, "Accept-Encoding")
+	encoding, encodingQ, _ := acceptQ(specs, "gzip")
+	_, identityQ, identityOK := acceptQ(specs, "identity")
+
+	// Any nonzero q-value makes gzip acceptable. As it's
+	// the only coding offered, it's only passed over for
+	// identity if the client explicitly prefers identity;
+	// the implicit acceptability of identity doesn't rank
+	// above even the lowest q-value.
+	if encodingQ <= 0 || (identityOK && identityQ > encodingQ) {
+		return ""
+	}
+
+	return encoding
+}
+
+// acceptQ returns the q-value that specs, parsed from an
+// Accept-Encoding header, give to the content coding enc,
+// either explicitly or by a * entry. value is the coding
+// as it was listed, or enc if it matched a * entry. ok is
+// false if neither was present.
+func acceptQ(specs []header.AcceptSpec, enc string) (value string, q float64, ok bool) {
+	enc = canonicalEncoding(enc)
+
+	var (
+		wildcardQ   float64
+		hasWildcard bool
+	)
+	for _, spec := range specs {
+		switch {
+		case canonicalEncoding(spec.Value) == enc:
+			return spec.Value, spec.Q, true
+		case spec.Value == "*" && !hasWildcard:
+			wildcardQ, hasWildcard = spec.Q, true
+		}
+	}
+
+	if !hasWildcard {
+		return "", 0, false
+	}
+
+	return enc, wildcardQ, true
+}
+
+// negotiatedKey is the context key for the negotiated
+// value of a request.
+type negotiatedKey struct{}
+
+// negotiated caches the result of negotiate for the
+// Accept-Encoding header it was computed from.
+type negotiated struct {
+	acceptEncoding []string
+	encoding       string
+}
+
+// lookupNegotiated returns the cached result of negotiate
+// for r, if the Accept-Encoding header is unchanged since
+// it was cached.
+func lookupNegotiated(r *http.Request) (string, bool) {
+	n, ok := r.Context().Value(negotiatedKey{}).(*negotiated)
+	if !ok {
+		return "", false
+	}
+
+	ae := r.Header["Accept-Encoding"]
+	if len(ae) != len(n.acceptEncoding) {
+		return "", false
+	}
+
+	for i := range ae {
+		if ae[i] != n.acceptEncoding[i] {
+			return "", false
+		}
+	}
+
+	return n.encoding, true
+}
+
+// negotiateRequest returns the content coding the gzip
+// handler compresses the response to r with, or an empty
+// string if it doesn't. If the client accepts gzip, the
+// result is cached in the context of the returned request,
+// so that nested handlers and NegotiatedEncoding don't
+// parse the header again. Other requests are returned
+// as is, to keep allocations off the pass-through path.
+func negotiateRequest(r *http.Request, assumeGzip bool) (string, *http.Request) {
+	if encoding, ok := lookupNegotiated(r); ok {
+		return encoding, r
+	}
+
+	encoding := negotiate(r.Header)
+
+	// A missing Accept-Encoding header means any encoding
+	// is acceptable, while an empty one means only the
+	// identity encoding is, see RFC 9110, section 12.5.3.
+	// Only the former is compressed with AssumeGzip.
+	if _, ok := r.Header["Accept-Encoding"]; !ok && assumeGzip {
+		encoding = "gzip"
+	}
+
+	if encoding == "" {
+		return "", r
+	}
+
+	n := &negotiated{
+		acceptEncoding: r.Header["Accept-Encoding"],
+		encoding:       encoding,
+	}
+	ctx := context.WithValue(r.Context(), negotiatedKey{}, n)
+	return encoding, r.WithContext(ctx)
+}
+
+// NegotiatedEncoding returns the gzip content coding
+// negotiated for r by an enclosing gzip handler, as it
+// appeared in the Accept-Encoding header. If gzip was only
+// accepted by a * entry, or assumed with
+// Options.AssumeGzip, it returns "gzip". This allows
+// other encoding-aware middleware to reuse the result
+// without parsing the header again.
+//
+// ok is false if r was not passed through a gzip handler,
+// if the client doesn't accept gzip, or if its
+// Accept-Encoding header has since been modified.
+func NegotiatedEncoding(r *http.Request) (encoding string, ok bool) {
+	return lookupNegotiated(r)
+}
+
+// Negotiate returns the content coding from offered that
+// the client most prefers, according to the q-values of
+// the Accept-Encoding header of r, as defined in RFC 9110
+// section 12.5.3. Ties are broken by the order of offered,
+// so the server's preferred coding should be listed first.
+// Content codings are compared case-insensitively, x-gzip
+// is an alias for gzip, and codings not listed explicitly
+// are matched by a * entry. A gzip handler compresses a
+// response only if Negotiate, offered just gzip, would
+// choose it.
+//
+// If none of offered is acceptable, or if identity is
+// preferred over them, Negotiate returns "identity".
+// Identity is acceptable unless it is excluded with
+// identity;q=0, or with *;q=0 and no identity entry, in
+// which case acceptable is false and the server should
+// respond with 406 Not Acceptable.
+//
+// A request without an Accept-Encoding header accepts any
+// coding, but is sent identity as not every client that
+// omits the header can decode the response.
+func Negotiate(r *http.Request, offered []string) (chosen string, acceptable bool) {
+	if _, ok := r.Header["Accept-Encoding"]; !ok {
+		return "identity", true
+	}
+
+	specs := header.ParseAccept(r.Header, "Accept-Encoding")
+
+	chosen, chosenQ := "", 0.0
+	for _, enc := range offered {
+		if _, q, _ := acceptQ(specs, enc); q > chosenQ {
+			chosen, chosenQ = enc, q
+		}
+	}
+
+	// As in negotiate, identity is only preferred over an
+	// acceptable coding if it's explicitly given a higher
+	// q-value.
+	_, identityQ, ok := acceptQ(specs, "identity")
+	if chosen != "" && (!ok || chosenQ >= identityQ) {
+		return chosen, true
+	}
+
+	return "identity", !ok || identityQ > 0
+}
+
+// canonicalEncoding returns the canonical token for the
+// content coding enc. Content codings are case-insensitive,
+// but are always written in lower case, and x-gzip is an
+// alias for gzip.
+func canonicalEncoding(enc string) string {
+	if enc == "gzip" {
+		return enc
+	}
+
+	enc = strings.ToLower(enc)
+	if enc == "x-gzip" {
+		return "gzip"
+	}
+
+	return enc
+}
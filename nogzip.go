@@ -0,0 +1,48 @@
+//go:build nogzip
+// +build nogzip
+
+package gziphandler
+
+import "net/http"
+
+// Compress, CompressTo, GunzipBytes, MustGunzip,
+// CaptureVariants and DecompressRequest need
+// "compress/gzip", so they aren't available with the
+// nogzip build tag. Negotiate, NegotiatedEncoding, Options
+// and the errors remain available, as they don't.
+
+// These constants match those in the gzip package, so
+// that code that imports "github.com/tmthrgd/gziphandler"
+// continues to build with the nogzip build tag without
+// importing "compress/gzip".
+const (
+	NoCompression      = 0
+	BestSpeed          = 1
+	BestCompression    = 9
+	DefaultCompression = -1
+	HuffmanOnly        = -2
+)
+
+// Gzip returns h unchanged. Compression is disabled by the
+// nogzip build tag.
+func Gzip(h http.Handler) http.Handler {
+	return h
+}
+
+// GzipWithLevel returns h unchanged. Compression is
+// disabled by the nogzip build tag.
+func GzipWithLevel(h http.Handler, level int) http.Handler {
+	return h
+}
+
+// GzipWithLevelAndMinSize returns h unchanged. Compression
+// is disabled by the nogzip build tag.
+func GzipWithLevelAndMinSize(h http.Handler, level, minSize int) http.Handler {
+	return h
+}
+
+// GzipWithOptions returns h unchanged. Compression is
+// disabled by the nogzip build tag.
+func GzipWithOptions(h http.Handler, opts *Options) http.Handler {
+	return h
+}
@@ -0,0 +1,58 @@
+//go:build nogzip
+// +build nogzip
+
+package gziphandler
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testBody = "aaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbcccaaabbbccc"
+
+func TestNoGzipPassThrough(t *testing.T) {
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testBody)
+	})
+
+	for _, handler := range []http.Handler{
+		Gzip(inner),
+		GzipWithLevel(inner, BestSpeed),
+		GzipWithLevelAndMinSize(inner, BestSpeed, 0),
+		GzipWithOptions(inner, &Options{Level: BestSpeed}),
+	} {
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		res := resp.Result()
+
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, "", res.Header.Get("Content-Encoding"))
+		assert.Equal(t, "", res.Header.Get("Vary"))
+		assert.Equal(t, testBody, resp.Body.String())
+	}
+}
+
+func TestNoGzipNegotiate(t *testing.T) {
+	var handlerReq *http.Request
+	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerReq = r
+	}))
+
+	req, _ := http.NewRequest("GET", "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	chosen, acceptable := Negotiate(handlerReq, []string{"gzip"})
+	assert.Equal(t, "gzip", chosen)
+	assert.True(t, acceptable)
+
+	// The request didn't pass through a gzip handler.
+	_, ok := NegotiatedEncoding(handlerReq)
+	assert.False(t, ok)
+}
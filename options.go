@@ -0,0 +1,673 @@
+package gziphandler
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"sync"
+)
+
+// These errors describe invalid Options. GzipWithOptions
+// panics with one of these errors if passed invalid
+// Options.
+var (
+	ErrInvalidLevel           = errors.New("invalid compression level requested")
+	ErrNegativeMinSize        = errors.New("minimum size must be more than zero")
+	ErrNegativeSampleRatio    = errors.New("sample ratio must not be negative")
+	ErrInvalidGzipOS          = errors.New("invalid gzip OS value requested")
+	ErrNegativeMaxConcurrent  = errors.New("maximum concurrency must not be negative")
+	ErrMinSizeTooSmall        = errors.New("minimum size is below MinRecommendedSize")
+	ErrNegativeMaxInput       = errors.New("maximum compress input must not be negative")
+	ErrInvalidRoutePattern    = errors.New("invalid always compress route pattern")
+	ErrGzipExtraTooLong       = errors.New("gzip extra field exceeds 65535 bytes")
+	ErrNegativeStreamBuffer   = errors.New("stream buffer size must not be negative")
+	ErrNegativeLengthBuffer   = errors.New("content length buffer size must not be negative")
+	ErrNegativeDecisionWindow = errors.New("decision window must not be negative")
+)
+
+// MinRecommendedSize is the smallest recommended non-zero
+// MinSize. The gzip header and trailer add around 20 bytes
+// to every response, so smaller responses rarely shrink
+// when compressed.
+const MinRecommendedSize = 150
+
+// OptInHeader is the response header with which a handler
+// asks for its response to be compressed, see
+// Options.OptIn.
+const OptInHeader = "X-Compress"
+
+// Options is a struct that defines options to customise
+// the behaviour of the gzip handler.
+type Options struct {
+	// Level is the gzip compression level to apply.
+	// See the level constants defined in this package.
+	//
+	// The default value adds gzip framing but performs
+	// no compression.
+	Level int
+
+	// MinSize specifies the minimum size of a response
+	// before it will be compressed. Responses smaller
+	// than this value will not be compressed.
+	//
+	// If MinSize is zero, all responses will be
+	// compressed. Otherwise it should be at least
+	// MinRecommendedSize, see EnforceMinRecommended.
+	MinSize int
+
+	// MinSizeFunc, if set, is called with each request
+	// that may be compressed to determine the minimum
+	// size of the response before it will be compressed.
+	// It overrides MinSize and allows the minimum size to
+	// depend on the request, for instance on its path.
+	//
+	// If MinSizeFunc returns a negative value, MinSize is
+	// used instead and ErrNegativeMinSize is passed to
+	// OnError.
+	MinSizeFunc func(*http.Request) int
+
+	// CanCompress can be set to a function to conditionally
+	// compress the data stream. Usually, the function will
+	// read the Content-Type header to determine whether
+	// it makes sense to compress the data.
+	CanCompress func(http.Header) bool
+
+	// CanCompressFull is like CanCompress, but is also
+	// passed the request so that it may, for instance,
+	// consider the request method or path. If both are
+	// set, CanCompressFull is used and CanCompress is
+	// ignored.
+	CanCompressFull func(*http.Request, http.Header) bool
+
+	// OnlyCacheable, if true, restricts compression to
+	// responses that are cacheable. A response is
+	// considered cacheable if it has either a
+	// Cache-Control header containing the public
+	// directive or an ETag header. A response with a
+	// Cache-Control header containing the no-store
+	// directive is never considered cacheable.
+	//
+	// Responses that are not cacheable are passed
+	// through uncompressed.
+	OnlyCacheable bool
+
+	// EmitUncompressedLength, if true, sets the
+	// X-Uncompressed-Content-Length header on compressed
+	// responses to the length of the uncompressed body.
+	//
+	// The length is known if the handler set the
+	// Content-Length header before the response was
+	// compressed, or once the handler returns if the
+	// response is buffered in full, see HTTP10Buffer and
+	// BufferForContentLength. Other streamed responses
+	// without a Content-Length header will not have the
+	// header set, see UncompressedLengthTrailer.
+	EmitUncompressedLength bool
+
+	// UncompressedLengthTrailer, if true, sends the
+	// length of the uncompressed body of streamed
+	// compressed responses, which is only known once the
+	// handler returns, in an
+	// X-Uncompressed-Content-Length trailer. Compressed
+	// responses that are buffered in full, see
+	// HTTP10Buffer and BufferForContentLength, have the
+	// header set instead. Responses that have the header
+	// from EmitUncompressedLength have no trailer.
+	UncompressedLengthTrailer bool
+
+	// Synchronized, if true, serializes calls to the
+	// WriteHeader, Write, Flush and Close methods of the
+	// http.ResponseWriter passed to the handler.
+	//
+	// Concurrent calls to an http.ResponseWriter are not
+	// permitted by net/http, but this may be useful as a
+	// defensive measure for handlers that write from
+	// multiple goroutines.
+	Synchronized bool
+
+	// DisableContentTypeSniff, if true, prevents the
+	// Content-Type header from being inferred from the
+	// uncompressed body when the handler did not set it.
+	//
+	// net/http will still sniff the Content-Type of
+	// responses that do not have one, but for compressed
+	// responses it will see the compressed body.
+	DisableContentTypeSniff bool
+
+	// HTTP10Mode specifies how responses to HTTP/1.0
+	// requests are handled. HTTP/1.0 does not support
+	// chunked transfer encoding, so a compressed
+	// response, which has no Content-Length, can only
+	// be delimited by closing the connection.
+	//
+	// The default value, HTTP10Stream, treats HTTP/1.0
+	// requests like any other.
+	HTTP10Mode HTTP10Mode
+
+	// BufferForContentLength, if non-zero, is the largest
+	// declared Content-Length of a response that is
+	// compressed in full before it is sent, so that it is
+	// sent with the Content-Length of the compressed
+	// response rather than chunked. Compressed responses
+	// without a Content-Length, or with a larger one, are
+	// streamed as usual.
+	//
+	// Validate returns ErrNegativeLengthBuffer if
+	// it is negative.
+	BufferForContentLength int
+
+	// GzipOS is the operating system value to write into
+	// the OS field of the gzip header, as defined in
+	// RFC 1952. It must be a value between 1 and 13, or
+	// 255 for an unknown operating system.
+	//
+	// The default value leaves the OS field as set by
+	// the gzip package, which is 255.
+	GzipOS byte
+
+	// GzipExtra, if set, is written into the extra field
+	// of the gzip header, as defined in RFC 1952, for
+	// tooling that reads it downstream. It must be at
+	// most 65535 bytes, the most the field can hold. Like
+	// GzipOS, it is only applied to a *gzip.Writer.
+	GzipExtra []byte
+
+	// SniffText, if true, decides whether to compress
+	// responses with a generic Content-Type, either
+	// application/octet-stream or none at all, by
+	// looking at the first 512 bytes of the response, or
+	// all of it buffered before the decision with
+	// DecisionWindow. Those that are mostly printable
+	// ASCII are compressed, while those that aren't are
+	// passed through.
+	//
+	// CanCompress is not called for such responses.
+	SniffText bool
+
+	// FlushOnClose, if true, flushes the underlying
+	// http.ResponseWriter when the response is closed
+	// after the handler returns. If the underlying
+	// http.ResponseWriter has a FlushError method, as
+	// those from net/http do, any error from flushing
+	// is returned from Close along with any other error.
+	// This allows a failure to deliver the end of the
+	// response to be observed. If the handler doesn't
+	// call Close itself, the error is passed to OnError.
+	//
+	// Flushing prevents net/http from setting the
+	// Content-Length of short responses.
+	FlushOnClose bool
+
+	// Stats, if set, is called with the request and the
+	// Stats for the response after the handler returns
+	// and the response has been closed.
+	//
+	// Collecting some stats has an overhead, which is
+	// only incurred if Stats is set.
+	Stats func(*http.Request, Stats)
+
+	// NoBuffer, if true, disables buffering the start of
+	// responses until MinSize is reached. Instead, the
+	// decision to compress is made on the first write,
+	// and the Content-Type is inferred from that write
+	// alone. Responses are compressed regardless of
+	// MinSize, unless the handler sets a Content-Length
+	// header smaller than MinSize.
+	//
+	// This avoids adding latency to streamed responses,
+	// for instance from a reverse proxy.
+	NoBuffer bool
+
+	// SkipLocalhost, if true, disables compression for
+	// requests made from a loopback address, such as
+	// 127.0.0.1 or ::1, as determined by the RemoteAddr
+	// of the request. This allows uncompressed responses
+	// to be inspected during development.
+	SkipLocalhost bool
+
+	// NewWriter, if set, is called to create the
+	// GzipWriter used to compress responses, in place of
+	// gzip.NewWriterLevel. It is passed a nil io.Writer
+	// and Level, and the returned GzipWriter will be
+	// Reset before use. This allows an alternative gzip
+	// implementation to be used. If it returns an error,
+	// the response is passed through uncompressed and the
+	// error is passed to OnError.
+	//
+	// The DEFLATE format used by gzip limits the window
+	// size to 32KB, so an implementation cannot use a
+	// larger window than compress/gzip does at
+	// BestCompression and still produce valid gzip.
+	// Larger windows require a different content coding,
+	// which this package does not support.
+	//
+	// GzipOS is only applied to a *gzip.Writer.
+	NewWriter func(w io.Writer, level int) (GzipWriter, error)
+
+	// WriterPool, if set, is used to pool the GzipWriters
+	// used at Level in place of a pool created for the
+	// handler. It allows a pool to be shared between
+	// handlers with the same Level and NewWriter, or to
+	// be instrumented. Writers are created with NewWriter
+	// when the pool is empty, so its New function may be
+	// left unset; if set, it must return GzipWriters at
+	// Level. A pooled value that isn't a GzipWriter is
+	// discarded, and the response is passed through
+	// uncompressed with ErrInvalidPooledWriter passed to
+	// OnError.
+	//
+	// The writers for other levels chosen by
+	// LevelUnderPressure are always pooled internally.
+	WriterPool *sync.Pool
+
+	// AuditLog, if set, is written a single line JSON
+	// record for each response after the handler returns
+	// and the response has been closed. The record is an
+	// object with the following fields:
+	//
+	//	method     the request method
+	//	path       the request URL path
+	//	encoding   the content coding of the response,
+	//	           either gzip or identity
+	//	size       the number of bytes written by the
+	//	           handler
+	//	sent_size  the number of bytes of the encoded
+	//	           response body
+	//
+	// Writes to AuditLog are serialized, but AuditLog
+	// must not be written to by anything else
+	// concurrently.
+	AuditLog io.Writer
+
+	// Tap, if set, receives a copy of the body of every
+	// response as written by the handler, before it is
+	// compressed, for debugging. Writes to Tap are
+	// serialized, so the bodies of concurrent responses
+	// are interleaved in the order they are written.
+	//
+	// Tap is written to synchronously, so a slow Tap
+	// slows every response. Errors writing to it are
+	// passed to OnError, but don't affect the response.
+	Tap io.Writer
+
+	// SampleRatio, if non-zero, enables trial compression
+	// of the first 512 bytes of each response that would
+	// otherwise be compressed, or with DecisionWindow, of
+	// all of the response buffered before the decision.
+	// If the ratio of the compressed size of the sample
+	// to its uncompressed size is greater than
+	// SampleRatio, the response is passed through
+	// uncompressed. A sample smaller than
+	// MinRecommendedSize, such as a small first write to
+	// a response that isn't buffered, is not checked.
+	//
+	// This detects responses that are poorly compressible
+	// regardless of their Content-Type, such as CSS that
+	// embeds images in base64 data URIs. A value of 0.9
+	// is reasonable.
+	SampleRatio float64
+
+	// DecisionWindow, if non-zero, is the number of bytes
+	// beyond MinSize that are buffered before deciding
+	// whether to compress a response. The decision is
+	// otherwise made on the write that reaches MinSize,
+	// which may straddle the boundary with data unlike
+	// what came before. SampleRatio and SniffText examine
+	// all of the buffered response, so a larger window
+	// makes them more accurate at the cost of latency and
+	// memory. A response that ends, or is flushed, within
+	// the window is still compressed if it reached
+	// MinSize.
+	//
+	// Validate returns ErrNegativeDecisionWindow if it is
+	// negative.
+	DecisionWindow int
+
+	// OnPush, if set, is called before the handler
+	// initiates an HTTP/2 server push with the target and
+	// options of the push. opts is never nil and may be
+	// modified, for instance to set an Accept-Encoding
+	// header for the promised request, which controls
+	// whether the pushed response will be compressed.
+	OnPush func(target string, opts *http.PushOptions)
+
+	// AssumeGzip, if true, compresses responses to
+	// requests without an Accept-Encoding header, as if
+	// the client accepted gzip. It is intended for trusted
+	// internal traffic where every client supports gzip.
+	//
+	// Requests with an Accept-Encoding header that does
+	// not accept gzip are never compressed. This includes
+	// an empty Accept-Encoding header, which means only
+	// the identity encoding is acceptable, as opposed to
+	// a missing header, which means any encoding is.
+	AssumeGzip bool
+
+	// LevelUnderPressure, if set, is called for each
+	// response that may be compressed and returns the
+	// compression level to use for it instead of Level.
+	// It allows the level to be lowered, for instance
+	// from BestCompression to BestSpeed, while the
+	// server is under load. If it returns an invalid
+	// level, Level is used instead and ErrInvalidLevel is
+	// passed to OnError.
+	LevelUnderPressure func() int
+
+	// SkipAttachments, if true, disables compression of
+	// responses with a Content-Disposition of attachment.
+	// Downloads are often large and compress well, but
+	// some clients save a compressed attachment without
+	// decoding it, for instance as report.csv.gz.
+	SkipAttachments bool
+
+	// SkipScriptTypes, if true, disables compression of
+	// responses with a JavaScript Content-Type, such as
+	// application/javascript or text/javascript. JSONP
+	// responses often reflect request input alongside
+	// secrets, which makes their compressed length an
+	// oracle for BREACH-style attacks. Other media types
+	// can be excluded with ExcludeContentTypes.
+	SkipScriptTypes bool
+
+	// Padding, if set, is called for each compressed
+	// response and returns the number of bytes of
+	// padding to add to it. The padding is written as a
+	// comment in the gzip header, so it is ignored by
+	// clients. Returning a random length decorrelates
+	// the compressed length from the content, which
+	// mitigates BREACH-style attacks on responses that
+	// mix secrets with request input. Values of zero or
+	// less add no padding.
+	//
+	// Padding is only added if NewWriter is nil or
+	// returns a *gzip.Writer.
+	Padding func() int
+
+	// DebugDisableParam, if set, is the name of a query
+	// parameter that disables compression of the
+	// response when present in the request URL, for
+	// instance "nocompress" for ?nocompress=1. It allows
+	// uncompressed responses to be inspected while
+	// reproducing an issue, regardless of the
+	// Accept-Encoding header.
+	DebugDisableParam string
+
+	// DebugDisableCookie, if set, is the name of a
+	// cookie that disables compression of the response
+	// when present in the request, like
+	// DebugDisableParam.
+	DebugDisableCookie string
+
+	// MaxConcurrent, if non-zero, is the maximum number
+	// of responses the handler compresses at once.
+	// Responses that would exceed it are passed through
+	// uncompressed rather than waiting, which trades
+	// bandwidth for latency and keeps compression from
+	// saturating every core under extreme load.
+	MaxConcurrent int
+
+	// StreamBufferSize, if non-zero, is the size of a
+	// fixed buffer between the gzip writer and the
+	// underlying http.ResponseWriter of streamed
+	// compressed responses. Compressed output is written
+	// to the underlying response whenever the buffer
+	// fills, when the response is flushed and when it is
+	// closed, so each in-flight response holds at most
+	// StreamBufferSize bytes of compressed output. The
+	// buffers are pooled.
+	//
+	// Validate returns ErrNegativeStreamBuffer if it is
+	// negative.
+	StreamBufferSize int
+
+	// EnforceMinRecommended, if true, makes a non-zero
+	// MinSize below MinRecommendedSize invalid, so that
+	// Validate returns ErrMinSizeTooSmall.
+	EnforceMinRecommended bool
+
+	// ContentTypeRewrite, if set, is called with the
+	// Content-Type of each response, whether set by the
+	// handler or inferred from the response, just before
+	// the header is written. Its result replaces the
+	// Content-Type, for instance to consistently add a
+	// charset parameter. It is not called for responses
+	// without a Content-Type.
+	ContentTypeRewrite func(contentType string) string
+
+	// MaxCompressInput, if non-zero, bounds the time and
+	// memory spent compressing a single response.
+	// Responses with a declared Content-Length larger than
+	// MaxCompressInput are passed through uncompressed.
+	//
+	// It is a guard based on the Content-Length as a
+	// hint, checked when the decision to compress is
+	// made: the bytes actually written are not counted.
+	// Responses without a Content-Length are not
+	// limited, since a response can't switch from
+	// compressed to uncompressed part way through.
+	MaxCompressInput int64
+
+	// OnError, if set, is called with errors the handler
+	// recovers from, such as NewWriter failing to create
+	// a GzipWriter, in which case the response is passed
+	// through uncompressed. It is also called with any
+	// error from closing the response after the handler
+	// returns, unless the handler closed it itself.
+	OnError func(r *http.Request, err error)
+
+	// EstimateHeader, if set, is the name of a response
+	// header, such as X-Estimated-Size, with which a
+	// handler that can't set a Content-Length may give
+	// the approximate length of the response. If the
+	// estimate is at least MinSize, the response isn't
+	// buffered and the decision to compress it is made
+	// on the first write, which reduces the latency of
+	// large streamed responses. Otherwise, the response
+	// is buffered as usual. The estimate never affects
+	// how the bytes written are handled, and the header
+	// is removed before the response is sent.
+	EstimateHeader string
+
+	// OptIn, if true, inverts the default so that only
+	// responses whose handler opts in are compressed. A
+	// handler opts in by setting the OptInHeader header to
+	// "1" before the first write to the response. The
+	// response must still be otherwise compressible. The
+	// header is removed before the response is sent.
+	OptIn bool
+
+	// DebugHeader, if true, adds an X-Compression header
+	// to each response describing how it was sent, which
+	// helps diagnose why a cache stored the wrong
+	// variant. The value is one of:
+	//
+	//   - gzip, if the response was compressed;
+	//   - identity, if the response could have been
+	//     compressed but wasn't, for instance because it
+	//     was smaller than MinSize; or
+	//   - passthrough, if the response was never
+	//     considered for compression, for instance
+	//     because the client doesn't accept gzip.
+	DebugHeader bool
+
+	// EmitDigest, if true, adds a Content-Digest header,
+	// as defined in RFC 9530, with the SHA-256 digest of
+	// the compressed response when the request asks for
+	// one with a Want-Content-Digest header giving sha-256
+	// a non-zero preference. The header must be sent
+	// before the response, so the digest is only added
+	// to compressed responses that are buffered in full,
+	// see HTTP10Buffer and BufferForContentLength.
+	// Streamed responses have no digest.
+	EmitDigest bool
+
+	// RecomputeDigest, if true, compresses responses with a
+	// Content-MD5 or Digest header set by the handler, which
+	// are otherwise passed through as the digests were
+	// computed over the uncompressed response. The digests
+	// are recomputed over the compressed response when it
+	// is buffered in full, see HTTP10Buffer and
+	// BufferForContentLength, and removed from streamed
+	// responses. Digest algorithms other than
+	// MD5, SHA-256 and SHA-512 are removed.
+	RecomputeDigest bool
+
+	// SkipOnSetCookie, if true, disables compression of
+	// responses with a Set-Cookie header. Like
+	// SkipScriptTypes, it mitigates BREACH-style attacks
+	// on responses that set a session cookie alongside
+	// reflected request input. The cookie must be set
+	// before the first write to the response.
+	SkipOnSetCookie bool
+
+	// AlwaysCompressRoutes is a list of patterns, in the
+	// syntax of path.Match, for routes known to return
+	// large compressible responses, such as "/api/*".
+	// Responses to requests whose URL path matches one of
+	// them are compressed as if MinSize were zero: they
+	// aren't buffered, and the decision to compress is
+	// made on the first write, so even a tiny response is
+	// compressed. The response must still be otherwise
+	// compressible, for instance by its Content-Type.
+	//
+	// This also suits health and readiness endpoints,
+	// such as "/healthz", polled by monitoring clients
+	// that expect every response to be compressed, even
+	// though the gzip framing makes a tiny response
+	// larger.
+	//
+	// Validate returns ErrInvalidRoutePattern if a
+	// pattern is malformed.
+	AlwaysCompressRoutes []string
+
+	// AlwaysCompressTypes is a list of media types, such
+	// as "image/svg+xml", that are compressed whatever
+	// their size, as if MinSize were zero. Larger
+	// responses of other types are still compressed.
+	// Types are matched as with CompressibleContentTypes.
+	// If the handler doesn't set a Content-Type before
+	// the first write, it is sniffed from that write.
+	AlwaysCompressTypes []string
+
+	// CompressedCache, if set, caches compressed
+	// responses with a strong ETag, so that a later
+	// response with the same ETag for the same URL reuses
+	// the compressed bytes rather than compressing again.
+	// The handler still runs, but what it writes is
+	// discarded, so it must write identical bytes for an
+	// identical ETag, as RFC 9110 requires of strong
+	// ETags. The ETag must be set before the first write.
+	//
+	// Responses are recorded as they are compressed, up
+	// to the size of the cache, so it is best suited to
+	// small, frequently requested responses. Responses
+	// are never cached with Padding.
+	//
+	// A cache may be shared between handlers to bound
+	// their combined memory, but each handler only reuses
+	// the responses it compressed itself, as handlers may
+	// differ in Level, GzipOS, GzipExtra or NewWriter. A
+	// response replayed from the cache doesn't count
+	// towards MaxConcurrent.
+	CompressedCache *CompressedCache
+
+	// FlushOnNewline, if true, flushes compressed
+	// newline-delimited JSON responses, with a
+	// Content-Type such as application/x-ndjson, after
+	// each write that ends in a newline, so that clients
+	// consuming the stream incrementally can decode each
+	// line as soon as it's written. These responses are
+	// also not buffered up to MinSize. Each flush costs a
+	// few bytes of compression ratio.
+	FlushOnNewline bool
+}
+
+// HTTP10Mode specifies how responses to HTTP/1.0
+// requests are handled.
+type HTTP10Mode int
+
+const (
+	// HTTP10Stream compresses responses to HTTP/1.0
+	// requests as they are written, without a
+	// Content-Length.
+	HTTP10Stream HTTP10Mode = iota
+
+	// HTTP10PassThrough never compresses responses to
+	// HTTP/1.0 requests.
+	HTTP10PassThrough
+
+	// HTTP10Buffer buffers the entire compressed
+	// response to HTTP/1.0 requests so that it can be
+	// sent with a Content-Length.
+	HTTP10Buffer
+)
+
+// Validate returns one of the Err* errors if the Options
+// are invalid. GzipWithOptions panics with the same error,
+// so Validate allows Options to be checked up front, for
+// instance while parsing configuration.
+func (opts *Options) Validate() error {
+	if !validLevel(opts.Level) {
+		return ErrInvalidLevel
+	}
+
+	if opts.MinSize < 0 {
+		return ErrNegativeMinSize
+	}
+
+	if opts.EnforceMinRecommended &&
+		opts.MinSize != 0 && opts.MinSize < MinRecommendedSize {
+		return ErrMinSizeTooSmall
+	}
+
+	if opts.SampleRatio < 0 {
+		return ErrNegativeSampleRatio
+	}
+
+	if opts.MaxConcurrent < 0 {
+		return ErrNegativeMaxConcurrent
+	}
+
+	if opts.MaxCompressInput < 0 {
+		return ErrNegativeMaxInput
+	}
+
+	if opts.StreamBufferSize < 0 {
+		return ErrNegativeStreamBuffer
+	}
+
+	if opts.BufferForContentLength < 0 {
+		return ErrNegativeLengthBuffer
+	}
+
+	if opts.DecisionWindow < 0 {
+		return ErrNegativeDecisionWindow
+	}
+
+	for _, pattern := range opts.AlwaysCompressRoutes {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return ErrInvalidRoutePattern
+		}
+	}
+
+	// The length of the extra field is stored in two
+	// bytes.
+	if len(opts.GzipExtra) > 0xffff {
+		return ErrGzipExtraTooLong
+	}
+
+	// RFC 1952 defines values 0 through 13 and 255.
+	if opts.GzipOS > 13 && opts.GzipOS != 255 {
+		return ErrInvalidGzipOS
+	}
+
+	return nil
+}
+
+// validLevel reports whether level is a compression level
+// accepted by Options.Level.
+func validLevel(level int) bool {
+	return level == DefaultCompression ||
+		(level >= BestSpeed && level <= BestCompression)
+}
@@ -0,0 +1,127 @@
+package gziphandler
+
+import (
+	"net/http"
+	"strings"
+)
+
+// DefaultCompressiblePredicate is a predicate, suitable
+// for use as Options.CanCompress, that reports whether the
+// Content-Type of the response is one of a set of common
+// compressible media types.
+var DefaultCompressiblePredicate = CompressibleContentTypes(
+	"text/*",
+	"application/javascript",
+	"application/json",
+	"application/ld+json",
+	"application/manifest+json",
+	"application/rss+xml",
+	"application/atom+xml",
+	"application/xhtml+xml",
+	"application/xml",
+	"application/wasm",
+	"image/svg+xml",
+	"image/x-icon",
+	"font/otf",
+	"font/ttf",
+)
+
+// scriptContentTypes are the media types of scripts, which
+// are not compressed with Options.SkipScriptTypes.
+var scriptContentTypes = []string{
+	"application/javascript",
+	"application/ecmascript",
+	"application/x-javascript",
+	"text/javascript",
+	"text/ecmascript",
+}
+
+// lineDelimitedContentTypes are the media types of
+// newline-delimited streams, which are flushed after each
+// line with Options.FlushOnNewline.
+var lineDelimitedContentTypes = []string{
+	"application/x-ndjson",
+	"application/ndjson",
+	"application/jsonl",
+}
+
+// multipartContentTypes are the media types of multipart
+// responses, such as the multipart/x-mixed-replace of an
+// MJPEG stream, which are live streams of parts that are
+// never buffered or compressed.
+var multipartContentTypes = []string{
+	"multipart/*",
+}
+
+// CompressibleContentTypes returns a predicate, suitable
+// for use as Options.CanCompress, that reports whether the
+// media type of the Content-Type header matches one of
+// types. Parameters, such as charset, are ignored and the
+// comparison is case insensitive. A type of the form
+// "text/*" matches any subtype.
+//
+// Responses without a Content-Type are not compressed.
+func CompressibleContentTypes(types ...string) func(http.Header) bool {
+	types = normalizeMediaTypes(types)
+	return func(hdr http.Header) bool {
+		return matchMediaType(types, mediaType(hdr))
+	}
+}
+
+// ExcludeContentTypes returns a predicate, suitable for
+// use as Options.CanCompress, that reports whether the
+// media type of the Content-Type header does not match any
+// of types. Types are matched as with
+// CompressibleContentTypes.
+//
+// Responses without a Content-Type are compressed.
+//
+// WebAssembly modules, of type application/wasm, are
+// compressed by default, as they compress well. To serve
+// them uncompressed to runtimes that don't expect an
+// encoded module, exclude "application/wasm".
+func ExcludeContentTypes(types ...string) func(http.Header) bool {
+	types = normalizeMediaTypes(types)
+	return func(hdr http.Header) bool {
+		mt := mediaType(hdr)
+		return mt == "" || !matchMediaType(types, mt)
+	}
+}
+
+func normalizeMediaTypes(types []string) []string {
+	normalized := make([]string, len(types))
+	for i, typ := range types {
+		normalized[i] = strings.ToLower(strings.TrimSpace(typ))
+	}
+
+	return normalized
+}
+
+// mediaType returns the lower case media type of the
+// Content-Type header without any parameters.
+func mediaType(hdr http.Header) string {
+	ct := hdr.Get("Content-Type")
+	if idx := strings.IndexByte(ct, ';'); idx != -1 {
+		ct = ct[:idx]
+	}
+
+	return strings.ToLower(strings.TrimSpace(ct))
+}
+
+func matchMediaType(types []string, mt string) bool {
+	if mt == "" {
+		return false
+	}
+
+	for _, typ := range types {
+		if strings.HasSuffix(typ, "/*") {
+			if strings.HasPrefix(mt, typ[:len(typ)-1]) {
+				return true
+			}
+		} else if typ == mt {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,87 @@
+package gziphandler
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressibleContentTypes(t *testing.T) {
+	canCompress := CompressibleContentTypes("text/*", "application/JSON")
+
+	for _, test := range []struct {
+		contentType string
+		expect      bool
+	}{
+		{"text/html", true},
+		{"text/plain; charset=utf-8", true},
+		{"TEXT/CSS", true},
+		{"application/json", true},
+		{"application/json; charset=utf-8", true},
+		{" application/json ;charset=utf-8", true},
+		{"application/jsonp", false},
+		{"application/javascript", false},
+		{"image/png", false},
+		{"texts/plain", false},
+		{"", false},
+	} {
+		hdr := make(http.Header)
+		if test.contentType != "" {
+			hdr.Set("Content-Type", test.contentType)
+		}
+
+		assert.Equal(t, test.expect, canCompress(hdr), "for Content-Type %q", test.contentType)
+	}
+}
+
+func TestExcludeContentTypes(t *testing.T) {
+	canCompress := ExcludeContentTypes("image/*", "application/zip")
+
+	for _, test := range []struct {
+		contentType string
+		expect      bool
+	}{
+		{"image/png", false},
+		{"IMAGE/JPEG", false},
+		{"application/zip", false},
+		{"application/zip; foo=bar", false},
+		{"application/json", true},
+		{"text/html; charset=utf-8", true},
+		{"", true},
+	} {
+		hdr := make(http.Header)
+		if test.contentType != "" {
+			hdr.Set("Content-Type", test.contentType)
+		}
+
+		assert.Equal(t, test.expect, canCompress(hdr), "for Content-Type %q", test.contentType)
+	}
+}
+
+func TestDefaultCompressiblePredicate(t *testing.T) {
+	for _, test := range []struct {
+		contentType string
+		expect      bool
+	}{
+		{"text/html; charset=utf-8", true},
+		{"text/plain", true},
+		{"application/json", true},
+		{"application/javascript", true},
+		{"image/svg+xml", true},
+		{"application/wasm", true},
+		{"image/png", false},
+		{"image/jpeg", false},
+		{"application/zip", false},
+		{"application/octet-stream", false},
+		{"video/mp4", false},
+		{"", false},
+	} {
+		hdr := make(http.Header)
+		if test.contentType != "" {
+			hdr.Set("Content-Type", test.contentType)
+		}
+
+		assert.Equal(t, test.expect, DefaultCompressiblePredicate(hdr), "for Content-Type %q", test.contentType)
+	}
+}
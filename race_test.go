@@ -0,0 +1,8 @@
+//go:build race && !nogzip
+// +build race,!nogzip
+
+package gziphandler
+
+func init() {
+	raceEnabled = true
+}
@@ -0,0 +1,76 @@
+package gziphandler
+
+import "time"
+
+// Stats describes how a response was written. They are
+// reported to Options.Stats.
+type Stats struct {
+	// Compressed is true if the response was compressed.
+	Compressed bool
+
+	// Encoding is the content coding of the response,
+	// "gzip" if it was compressed or "identity" if not.
+	Encoding string
+
+	// Reason is why the response was not compressed, or
+	// ReasonNone if it was.
+	Reason Reason
+
+	// Cached is true if the compressed response was
+	// served from Options.CompressedCache rather than
+	// compressed again.
+	Cached bool
+
+	// CompressDuration is the wall-clock time spent
+	// compressing the response, from the first write to
+	// the gzip writer through to its close. It only
+	// includes the time spent in calls to the gzip
+	// writer, which includes writing the compressed
+	// response to the underlying http.ResponseWriter.
+	CompressDuration time.Duration
+}
+
+// Reason is why a response was not compressed, see
+// Stats.Reason.
+type Reason int
+
+const (
+	// ReasonNone is the Reason of a compressed response.
+	ReasonNone Reason = iota
+
+	// ReasonNotAccepted means the request's
+	// Accept-Encoding header didn't accept gzip.
+	ReasonNotAccepted
+
+	// ReasonDenied means the Options or the request
+	// ruled out compressing the response, for instance by
+	// its Content-Type, CanCompress, HTTP10Mode,
+	// MaxConcurrent or a Range header.
+	ReasonDenied
+
+	// ReasonTooSmall means the response was smaller than
+	// MinSize when it ended or was first flushed.
+	ReasonTooSmall
+
+	// ReasonError means the gzip writer failed before
+	// sending anything, so the response was passed
+	// through, see Options.OnError.
+	ReasonError
+)
+
+func (r Reason) String() string {
+	switch r {
+	case ReasonNone:
+		return "none"
+	case ReasonNotAccepted:
+		return "not accepted"
+	case ReasonDenied:
+		return "denied"
+	case ReasonTooSmall:
+		return "too small"
+	case ReasonError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,64 @@
+package gziphandler
+
+import (
+	"errors"
+	"io"
+	"net/http"
+)
+
+// ErrWriteAfterClose is returned by writes to a response
+// after the handler has returned and the response has been
+// closed, for instance from a goroutine the handler
+// started. The write would otherwise go to a gzip writer
+// that has been returned to the pool and may be in use by
+// another response.
+var ErrWriteAfterClose = errors.New("write after response closed")
+
+// ErrInvalidPooledWriter is passed to Options.OnError when
+// Options.WriterPool returns a value that isn't a
+// GzipWriter.
+var ErrInvalidPooledWriter = errors.New("writer pool returned a value that is not a GzipWriter")
+
+// GzipWriter is the interface implemented by gzip
+// compressors, such as *gzip.Writer. An implementation
+// can be provided with Options.NewWriter.
+//
+// The output of a GzipWriter must be in the gzip format,
+// as defined by RFC 1952, as it is sent with a
+// Content-Encoding of gzip.
+type GzipWriter interface {
+	io.WriteCloser
+
+	// Flush writes any pending compressed data to the
+	// underlying writer.
+	Flush() error
+
+	// Reset discards the GzipWriter's state and makes it
+	// equivalent to the result of Options.NewWriter, but
+	// writing to w instead.
+	Reset(w io.Writer)
+}
+
+// ResponseWriter is implemented by the http.ResponseWriter
+// that the handlers returned by Gzip and its variants pass
+// to the handlers they wrap. Middleware can type-assert to
+// it to find out whether the response may be compressed.
+// With the nogzip build tag, handlers are not wrapped, so
+// nothing implements it.
+type ResponseWriter interface {
+	http.ResponseWriter
+
+	// Close finishes the response, compressing and
+	// writing out anything still buffered. It is called
+	// once the wrapped handler returns, but a handler may
+	// call it earlier, after which writes to the response
+	// return ErrWriteAfterClose.
+	io.Closer
+
+	// Flush writes out the compressed response so far.
+	// If the underlying response can be flushed,
+	// flushing before MinSize is reached decides not to
+	// compress the response, as the handler evidently
+	// wants it streamed.
+	http.Flusher
+}